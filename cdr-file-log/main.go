@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/iafan/cwalk"
+	"github.com/wadewyuan/go-tools/decompress"
 )
 
 func process(workPath string) {
@@ -29,7 +30,11 @@ func process(workPath string) {
 			}
 
 			log.Printf("Reading file %s\n", info.Name())
-			f, _ := os.Open(path)
+			f, err := decompress.Open(path)
+			if err != nil {
+				log.Println("ERROR", err)
+				return nil
+			}
 
 			scanner := bufio.NewScanner(f)
 			scanner.Split(bufio.ScanLines)
@@ -0,0 +1,228 @@
+// Package cdrstore writes the loading log of CDR files, the time span found in
+// each file, to a database or a file. The backend and the table layout are
+// chosen in the configuration.
+package cdrstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	alarm "github.com/wadewyuan/smartom-utils-go"
+)
+
+// Record is a loading log entry, one per file or per segment of a file
+type Record struct {
+	GwType   int       `json:"gw_type"`
+	FileName string    `json:"file_name"`
+	FileTime time.Time `json:"file_time"`
+	Begin    time.Time `json:"begin"`
+	End      time.Time `json:"end"`
+	Segment  int       `json:"segment"`
+	Version  int       `json:"version"`
+	Logged   time.Time `json:"logged"`
+
+	// Statistics of the file
+	Records  int            `json:"records,omitempty"`
+	BadLines int            `json:"bad_lines,omitempty"`
+	Hours    map[string]int `json:"hours,omitempty"` // yyyyMMddHH -> records
+	Size     int64          `json:"size,omitempty"`
+	Hash     string         `json:"hash,omitempty"`
+}
+
+// field returns the value of a record field by its name in a table
+func (r *Record) field(name string) interface{} {
+	switch name {
+	case "gwtype":
+		return r.GwType
+	case "filename":
+		return r.FileName
+	case "filetime":
+		return r.FileTime
+	case "begin":
+		return r.Begin
+	case "end":
+		return r.End
+	case "segment":
+		return r.Segment
+	case "version":
+		return r.Version
+	case "now":
+		return r.Logged
+	case "records":
+		return r.Records
+	case "badlines":
+		return r.BadLines
+	case "hours":
+		b, _ := json.Marshal(r.Hours)
+		return string(b)
+	case "size":
+		return r.Size
+	case "hash":
+		return r.Hash
+	}
+	return nil
+}
+
+// key identifies the file, or the segment of a file, the record is about
+func (r *Record) key(fields []string) string {
+	var values []string
+	for _, f := range fields {
+		values = append(values, fmt.Sprint(r.field(f)))
+	}
+	return strings.Join(values, "\t")
+}
+
+// Store is a loading log backend
+type Store interface {
+	// Log writes the records
+	Log(records ...*Record) error
+
+	// Missing returns the file names which have no entry in the log
+	Missing(names []string) ([]string, error)
+
+	Close() error
+}
+
+// Table maps the records to the columns of a table
+type Table struct {
+	Name string
+
+	// Columns to insert into, when empty the values are inserted in table order
+	Columns []string
+
+	// A value per column, either a record field (gwtype, filename, filetime,
+	// begin, end, segment, version, now, or the statistics records, badlines,
+	// hours as JSON, size, hash) or any other SQL expression, e.g. SYSDATE
+	Values []string
+
+	// Record fields identifying a row, e.g. gwtype and filename. When set, a
+	// file logged again is handled by the conflict policy instead of being
+	// inserted twice; the table needs Columns and a unique key on their
+	// columns. The "version" policy adds rows with the same key, the unique
+	// key then has to include the version column.
+	Key []string
+
+	// Column holding the file name, default FILE_NAME
+	FileColumn string
+}
+
+type Options struct {
+	// "oracle" (the default), "postgres", "sqlite" or "jsonl"
+	Backend string
+
+	// Connection to Oracle or PostgreSQL, Sid is the database name for PostgreSQL
+	Host     string
+	Port     string
+	Sid      string
+	Username string
+	Password string
+
+	// Data source name, used instead of the connection fields when set
+	Dsn string
+
+	// Database file for SQLite, or the log file for jsonl
+	File string
+
+	// Table of the log, the default of the program is used when Name isn't set
+	Table Table
+
+	// Connections kept open to the database, default 4
+	MaxConns int
+
+	// Time zone of the database session, e.g. Asia/Hong_Kong. Every
+	// connection sets it as its session time zone, which SQL expressions
+	// like CURRENT_DATE use, and the times are written as wall clock times
+	// in this zone, which is what columns without a time zone like Oracle's
+	// DATE store. Unset, they're written in the zone they were parsed in.
+	// SQLite has no session time zone, only the times are converted.
+	TimeZone string
+
+	// Batching of the writes, see NewWriter
+	Batch BatchOptions
+
+	// What to do when a file with a key already logged is logged with other
+	// times: "overwrite" the row (the default), "keep" the first one, or
+	// "version" to add a row with the next version and raise the alarm
+	Conflict string
+
+	// Alarm raised for a new version of a file
+	AlarmCode string
+}
+
+// Open connects to the backend. The table of opts is used when it has a name,
+// otherwise the given default.
+func Open(opts Options, table Table) (Store, error) {
+	if len(opts.Table.Name) > 0 {
+		table = opts.Table
+	}
+	for i, k := range table.Key {
+		table.Key[i] = strings.ToLower(k)
+	}
+	switch opts.Conflict {
+	case "":
+		opts.Conflict = "overwrite"
+	case "overwrite", "keep", "version":
+	default:
+		return nil, fmt.Errorf("cdrstore: unknown conflict policy: %s", opts.Conflict)
+	}
+
+	switch opts.Backend {
+	case "", "oracle", "postgres", "sqlite":
+		return openSQL(opts, table)
+	case "jsonl":
+		return openJSONL(opts, table)
+	default:
+		return nil, fmt.Errorf("cdrstore: unknown backend: %s", opts.Backend)
+	}
+}
+
+// resolve applies the conflict policy to a record whose key was logged before
+// as old, nil if it wasn't, and reports whether it should be written
+func resolve(opts *Options, old, r *Record) bool {
+	if old == nil {
+		r.Version = 1
+		return true
+	}
+	if old.Begin.Equal(r.Begin) && old.End.Equal(r.End) {
+		return false
+	}
+
+	switch opts.Conflict {
+	case "keep":
+		log.Printf("File %s was logged with other times, keeping the first\n", r.FileName)
+		return false
+	case "version":
+		r.Version = old.Version + 1
+		msg := fmt.Sprintf("CDR file %s was logged with other times, adding version %d", r.FileName, r.Version)
+		log.Println(msg)
+		if len(opts.AlarmCode) > 0 {
+			alarm.SendAlarm(opts.AlarmCode, msg)
+		}
+		return true
+	default:
+		log.Printf("File %s was logged with other times, overwriting\n", r.FileName)
+		r.Version = old.Version
+		return true
+	}
+}
+
+// dedup keeps the last record of every key
+func dedup(records []*Record, key []string) []*Record {
+	if len(key) == 0 {
+		return records
+	}
+	last := make(map[string]int)
+	for i, r := range records {
+		last[r.key(key)] = i
+	}
+	var kept []*Record
+	for i, r := range records {
+		if last[r.key(key)] == i {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
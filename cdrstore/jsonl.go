@@ -0,0 +1,95 @@
+package cdrstore
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// jsonlStore appends the records to a file as JSON lines, for lab setups
+// without a database or to feed other tools. The latest record of every key
+// is kept in memory to apply the conflict policy.
+type jsonlStore struct {
+	mu     sync.Mutex
+	opts   Options
+	key    []string
+	latest map[string]*Record
+	names  map[string]bool
+	file   *os.File
+}
+
+func openJSONL(opts Options, table Table) (*jsonlStore, error) {
+	if len(opts.File) == 0 {
+		return nil, errors.New("cdrstore: no file for the jsonl backend")
+	}
+	s := &jsonlStore{
+		opts:   opts,
+		key:    table.Key,
+		latest: make(map[string]*Record),
+		names:  make(map[string]bool),
+	}
+	if len(s.key) == 0 {
+		s.key = []string{"gwtype", "filename", "segment"}
+	}
+
+	err := readSpool(opts.File, func(r *Record) {
+		k := r.key(s.key)
+		if l, ok := s.latest[k]; !ok || r.Version >= l.Version {
+			s.latest[k] = r
+		}
+		s.names[r.FileName] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.file, err = os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *jsonlStore) Log(records ...*Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b []byte
+	for _, r := range dedup(records, s.key) {
+		k := r.key(s.key)
+		if !resolve(&s.opts, s.latest[k], r) {
+			continue
+		}
+		if r.Logged.IsZero() {
+			r.Logged = time.Now()
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+		s.latest[k] = r
+		s.names[r.FileName] = true
+	}
+	// A single write, so a crash doesn't leave part of the records
+	_, err := s.file.Write(b)
+	return err
+}
+
+func (s *jsonlStore) Missing(names []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var missing []string
+	for _, name := range names {
+		if !s.names[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+func (s *jsonlStore) Close() error {
+	return s.file.Close()
+}
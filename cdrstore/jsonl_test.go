@@ -0,0 +1,117 @@
+package cdrstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "log.jsonl")
+	begin := time.Date(2024, 1, 2, 1, 0, 0, 0, time.FixedZone("HKT", 8*3600))
+	in := &Record{
+		GwType:   3,
+		FileName: "a",
+		FileTime: begin.Truncate(time.Hour),
+		Begin:    begin,
+		End:      begin.Add(time.Hour),
+		Segment:  1,
+		Records:  10,
+		BadLines: 1,
+		Hours:    map[string]int{"2024010201": 10},
+		Size:     1234,
+		Hash:     "abcd",
+	}
+	s, err := Open(Options{Backend: "jsonl", File: file}, Table{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Log(in); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	var out []*Record
+	if err := readSpool(file, func(r *Record) { out = append(out, r) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 {
+		t.Fatalf("%d records read back", len(out))
+	}
+	if !equalRecords(out[0], in) {
+		t.Errorf("read back\n%+v\nwrote\n%+v", out[0], in)
+	}
+
+	// Reopened, the records logged before count for Missing and the conflicts
+	s, err = Open(Options{Backend: "jsonl", File: file, Conflict: "version"}, Table{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if missing, _ := s.Missing([]string{"a", "b"}); len(missing) != 1 || missing[0] != "b" {
+		t.Errorf("missing %v, want [b]", missing)
+	}
+	again := *in
+	if err := s.Log(&again); err != nil {
+		t.Fatal(err)
+	}
+	changed := *in
+	changed.End = changed.End.Add(time.Hour)
+	if err := s.Log(&changed); err != nil {
+		t.Fatal(err)
+	}
+	if changed.Version != 2 {
+		t.Errorf("version %d, want 2", changed.Version)
+	}
+	b, _ := os.ReadFile(file)
+	if n := strings.Count(string(b), "\n"); n != 2 {
+		t.Errorf("%d lines, want 2:\n%s", n, b)
+	}
+}
+
+// equalRecords compares records with their times as instants, JSON doesn't
+// keep the location
+func equalRecords(a, b *Record) bool {
+	x, y := *a, *b
+	for _, p := range []*time.Time{&x.FileTime, &x.Begin, &x.End, &x.Logged, &y.FileTime, &y.Begin, &y.End, &y.Logged} {
+		*p = p.UTC()
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestJSONLConflicts(t *testing.T) {
+	begin := time.Date(2024, 1, 2, 1, 0, 0, 0, time.UTC)
+	tests := []struct {
+		conflict string
+		want     []string // end hour and version of the lines
+	}{
+		{"overwrite", []string{"02 1", "03 1"}},
+		{"keep", []string{"02 1"}},
+		{"version", []string{"02 1", "03 2"}},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "log.jsonl")
+		s, err := Open(Options{Backend: "jsonl", File: file, Conflict: tt.conflict}, Table{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, end := range []int{2, 2, 3} {
+			if err := s.Log(&Record{FileName: "a", Begin: begin, End: begin.Add(time.Duration(end-1) * time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Close()
+
+		var got []string
+		readSpool(file, func(r *Record) {
+			got = append(got, fmt.Sprintf("%s %d", r.End.Format("15"), r.Version))
+		})
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: lines %v, want %v", tt.conflict, got, tt.want)
+		}
+	}
+}
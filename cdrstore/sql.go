@@ -0,0 +1,566 @@
+package cdrstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/sijms/go-ora"
+	_ "modernc.org/sqlite"
+)
+
+// Oracle doesn't take more than 1000 expressions in an IN list
+const maxInList = 500
+
+// Rows written by a single statement
+const maxRows = 200
+
+type sqlStore struct {
+	db      *sql.DB
+	backend string
+	opts    Options
+	table   Table
+	fields  []string // record field of each value, empty for SQL expressions
+	loc     *time.Location
+}
+
+func openSQL(opts Options, table Table) (*sqlStore, error) {
+	s := &sqlStore{backend: opts.Backend, opts: opts, table: table}
+	if len(s.backend) == 0 {
+		s.backend = "oracle"
+	}
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+	if len(opts.TimeZone) > 0 {
+		loc, err := time.LoadLocation(opts.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+		s.loc = loc
+	}
+
+	name, dsn := s.backend, opts.Dsn
+	if len(dsn) == 0 {
+		u := url.URL{
+			Scheme: s.backend,
+			User:   url.UserPassword(opts.Username, opts.Password),
+			Host:   opts.Host + ":" + opts.Port,
+			Path:   "/" + opts.Sid,
+		}
+		switch s.backend {
+		case "oracle":
+			dsn = u.String()
+		case "postgres":
+			dsn = u.String() + "?sslmode=disable"
+		case "sqlite":
+			dsn = opts.File
+		}
+	}
+
+	db, err := sql.Open(name, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if q := s.sessionTimeZone(); len(q) > 0 {
+		// Every connection of the pool gets the time zone when opened
+		d := db.Driver()
+		db.Close()
+		c, err := connector(d, dsn)
+		if err != nil {
+			return nil, err
+		}
+		db = sql.OpenDB(&sessionConnector{Connector: c, init: q})
+	}
+	// The pool lives as long as the store, connections are reused by every write
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = 4
+	}
+	db.SetMaxOpenConns(opts.MaxConns)
+	db.SetMaxIdleConns(opts.MaxConns)
+	db.SetConnMaxIdleTime(10 * time.Minute)
+	s.db = db
+	return s, nil
+}
+
+// sessionTimeZone returns the statement setting the time zone of a session,
+// empty when there's none to set. SQLite has no session time zone.
+func (s *sqlStore) sessionTimeZone() string {
+	if s.loc == nil {
+		return ""
+	}
+	zone := "'" + strings.ReplaceAll(s.opts.TimeZone, "'", "''") + "'"
+	switch s.backend {
+	case "oracle":
+		return "ALTER SESSION SET TIME_ZONE = " + zone
+	case "postgres":
+		return "SET TIME ZONE " + zone
+	}
+	return ""
+}
+
+// connector returns the connector of the driver to the data source
+func connector(d driver.Driver, dsn string) (driver.Connector, error) {
+	if dc, ok := d.(driver.DriverContext); ok {
+		return dc.OpenConnector(dsn)
+	}
+	return &dsnConnector{driver: d, dsn: dsn}, nil
+}
+
+// dsnConnector opens the connections of a driver without connectors
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c *dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// sessionConnector runs a statement on every new connection, e.g. to set the
+// time zone of its session
+type sessionConnector struct {
+	driver.Connector
+	init string
+}
+
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := execConn(ctx, conn, c.init); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// execConn runs a statement without arguments on a driver connection
+func execConn(ctx context.Context, conn driver.Conn, q string) error {
+	if e, ok := conn.(driver.ExecerContext); ok {
+		_, err := e.ExecContext(ctx, q, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+	stmt, err := conn.Prepare(q)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if se, ok := stmt.(driver.StmtExecContext); ok {
+		_, err = se.ExecContext(ctx, nil)
+	} else {
+		_, err = stmt.Exec(nil)
+	}
+	return err
+}
+
+// placeholder returns the bind variable n, counted from 1
+func (s *sqlStore) placeholder(n int) string {
+	switch s.backend {
+	case "oracle":
+		return fmt.Sprintf(":%d", n)
+	case "postgres":
+		return fmt.Sprintf("$%d", n)
+	default:
+		return "?"
+	}
+}
+
+// prepare checks the table and finds the record fields among its values
+func (s *sqlStore) prepare() error {
+	t := &s.table
+	if len(t.Values) == 0 {
+		return errors.New("cdrstore: no values for table " + t.Name)
+	}
+	if len(t.Columns) > 0 && len(t.Columns) != len(t.Values) {
+		return errors.New("cdrstore: columns and values of table " + t.Name + " don't match")
+	}
+	for _, v := range t.Values {
+		if isField(v) {
+			s.fields = append(s.fields, strings.ToLower(v))
+		} else {
+			s.fields = append(s.fields, "")
+		}
+	}
+
+	if len(t.FileColumn) == 0 {
+		t.FileColumn = s.column("filename")
+	}
+	if len(t.FileColumn) == 0 {
+		t.FileColumn = "FILE_NAME"
+	}
+	if len(t.Key) == 0 {
+		return nil
+	}
+	if len(t.Columns) == 0 {
+		return errors.New("cdrstore: table " + t.Name + " has a key but no columns")
+	}
+	need := append([]string{}, t.Key...)
+	if s.opts.Conflict == "version" {
+		need = append(need, "begin", "end", "version")
+	}
+	for _, f := range need {
+		if len(s.column(f)) == 0 {
+			return errors.New("cdrstore: no column for " + f + " in table " + t.Name)
+		}
+	}
+	return nil
+}
+
+func isField(v string) bool {
+	switch strings.ToLower(v) {
+	case "gwtype", "filename", "filetime", "begin", "end", "segment", "version", "now",
+		"records", "badlines", "hours", "size", "hash":
+		return true
+	}
+	return false
+}
+
+// column returns the column of a record field, empty if it isn't written
+func (s *sqlStore) column(field string) string {
+	for i, f := range s.fields {
+		if f == field && i < len(s.table.Columns) {
+			return s.table.Columns[i]
+		}
+	}
+	return ""
+}
+
+func (s *sqlStore) isKey(field string) bool {
+	for _, k := range s.table.Key {
+		if k == field {
+			return true
+		}
+	}
+	return false
+}
+
+// statement returns the statement writing n rows, an upsert when the table
+// has a key, except for the version policy which only adds rows
+func (s *sqlStore) statement(n int) string {
+	if len(s.table.Key) == 0 || s.opts.Conflict == "version" {
+		return s.insert(n)
+	}
+	if s.backend == "oracle" {
+		return s.merge(n)
+	}
+
+	var keys, set []string
+	for _, k := range s.table.Key {
+		keys = append(keys, s.column(k))
+	}
+	for i, f := range s.fields {
+		if len(f) > 0 && !s.isKey(f) && f != "version" {
+			set = append(set, s.table.Columns[i]+" = excluded."+s.table.Columns[i])
+		}
+	}
+	q := s.insert(n) + " ON CONFLICT (" + strings.Join(keys, ", ") + ")"
+	if s.opts.Conflict == "keep" || len(set) == 0 {
+		return q + " DO NOTHING"
+	}
+	return q + " DO UPDATE SET " + strings.Join(set, ", ")
+}
+
+// rows returns n rows of bind variables selected from DUAL for Oracle, which
+// has no multi-row VALUES, or as a VALUES list for the others. SQL expressions
+// of the table are left out of the rows selected from DUAL, so expressions
+// like a sequence's nextval are evaluated once per row written.
+func (s *sqlStore) rows(n int) string {
+	bind := 0
+	var rows []string
+	for i := 0; i < n; i++ {
+		var values []string
+		for j, f := range s.fields {
+			if len(f) == 0 {
+				if s.backend != "oracle" {
+					values = append(values, s.table.Values[j])
+				}
+				continue
+			}
+			bind++
+			if s.backend == "oracle" {
+				values = append(values, fmt.Sprintf("%s v%d", s.placeholder(bind), j))
+			} else {
+				values = append(values, s.placeholder(bind))
+			}
+		}
+		if s.backend == "oracle" {
+			rows = append(rows, "SELECT "+strings.Join(values, ", ")+" FROM DUAL")
+		} else {
+			rows = append(rows, "("+strings.Join(values, ", ")+")")
+		}
+	}
+	if s.backend == "oracle" {
+		return strings.Join(rows, " UNION ALL ")
+	}
+	return "VALUES " + strings.Join(rows, ", ")
+}
+
+// values returns the values of a row selected by rows as r
+func (s *sqlStore) values() string {
+	var values []string
+	for j, f := range s.fields {
+		if len(f) == 0 {
+			values = append(values, s.table.Values[j])
+		} else {
+			values = append(values, fmt.Sprintf("r.v%d", j))
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+func (s *sqlStore) insert(n int) string {
+	t := s.table
+	q := "INSERT INTO " + t.Name
+	if len(t.Columns) > 0 {
+		q += " (" + strings.Join(t.Columns, ", ") + ")"
+	}
+	if s.backend != "oracle" {
+		return q + " " + s.rows(n)
+	}
+	return q + " SELECT " + s.values() + " FROM (" + s.rows(n) + ") r"
+}
+
+// merge returns the Oracle upsert of n rows
+func (s *sqlStore) merge(n int) string {
+	t := s.table
+	var on, set []string
+	for i, f := range s.fields {
+		switch {
+		case len(f) == 0:
+		case s.isKey(f):
+			on = append(on, fmt.Sprintf("t.%s = r.v%d", t.Columns[i], i))
+		case f != "version":
+			set = append(set, fmt.Sprintf("t.%s = r.v%d", t.Columns[i], i))
+		}
+	}
+	q := "MERGE INTO " + t.Name + " t USING (" + s.rows(n) + ") r ON (" + strings.Join(on, " AND ") + ")"
+	if s.opts.Conflict != "keep" && len(set) > 0 {
+		q += " WHEN MATCHED THEN UPDATE SET " + strings.Join(set, ", ")
+	}
+	return q + " WHEN NOT MATCHED THEN INSERT (" + strings.Join(t.Columns, ", ") + ") VALUES (" + s.values() + ")"
+}
+
+// args returns the bind values of the record
+func (s *sqlStore) args(r *Record) []interface{} {
+	var args []interface{}
+	for _, f := range s.fields {
+		if len(f) == 0 {
+			continue
+		}
+		v := r.field(f)
+		if t, ok := v.(time.Time); ok && s.loc != nil {
+			v = t.In(s.loc)
+		}
+		args = append(args, v)
+	}
+	return args
+}
+
+// wallClock reads a time without a zone, which drivers return as UTC, as a
+// time in the session's zone
+func (s *sqlStore) wallClock(t time.Time) time.Time {
+	if s.loc == nil || t.Location() != time.UTC {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), s.loc)
+}
+
+// Log writes the records in a single transaction, up to maxRows per statement
+func (s *sqlStore) Log(records ...*Record) error {
+	records = dedup(records, s.table.Key)
+	if len(s.table.Key) > 0 && s.opts.Conflict == "version" {
+		var err error
+		if records, err = s.versions(records); err != nil {
+			return err
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(records); i += maxRows {
+		chunk := records[i:]
+		if len(chunk) > maxRows {
+			chunk = chunk[:maxRows]
+		}
+		var args []interface{}
+		for _, r := range chunk {
+			if r.Logged.IsZero() {
+				r.Logged = time.Now()
+			}
+			if r.Version == 0 {
+				r.Version = 1
+			}
+			args = append(args, s.args(r)...)
+		}
+		if _, err := tx.Exec(s.statement(len(chunk)), args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// versions looks up the latest version of every record's key and returns the
+// records to add under the version policy
+func (s *sqlStore) versions(records []*Record) ([]*Record, error) {
+	var names []string
+	for _, r := range records {
+		names = append(names, r.FileName)
+	}
+	fields := append(append([]string{}, s.table.Key...), "begin", "end", "version")
+	var columns []string
+	for _, f := range fields {
+		columns = append(columns, s.column(f))
+	}
+
+	latest := make(map[string]*Record)
+	err := s.query(columns, names, func(rows *sql.Rows) error {
+		old, err := scanRecord(rows, fields)
+		if err != nil {
+			return err
+		}
+		old.Begin, old.End = s.wallClock(old.Begin), s.wallClock(old.End)
+		k := old.key(s.table.Key)
+		if l, ok := latest[k]; !ok || old.Version > l.Version {
+			latest[k] = old
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var added []*Record
+	for _, r := range records {
+		if resolve(&s.opts, latest[r.key(s.table.Key)], r) {
+			added = append(added, r)
+		}
+	}
+	return added, nil
+}
+
+// scanRecord reads the fields of a record from the current row
+func scanRecord(rows *sql.Rows, fields []string) (*Record, error) {
+	r := &Record{}
+	var dest []interface{}
+	var ints []*sql.NullInt64
+	for _, f := range fields {
+		switch f {
+		case "filename":
+			dest = append(dest, &r.FileName)
+		case "filetime":
+			dest = append(dest, &r.FileTime)
+		case "begin":
+			dest = append(dest, &r.Begin)
+		case "end":
+			dest = append(dest, &r.End)
+		case "now":
+			dest = append(dest, &r.Logged)
+		default:
+			n := &sql.NullInt64{}
+			ints = append(ints, n)
+			dest = append(dest, n)
+		}
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	i := 0
+	for _, f := range fields {
+		switch f {
+		case "gwtype":
+			r.GwType = int(ints[i].Int64)
+		case "segment":
+			r.Segment = int(ints[i].Int64)
+		case "version":
+			r.Version = int(ints[i].Int64)
+		default:
+			continue
+		}
+		i++
+	}
+	return r, nil
+}
+
+// query selects the columns of the rows of the given file names, calling fn
+// for every row
+func (s *sqlStore) query(columns []string, names []string, fn func(*sql.Rows) error) error {
+	for i := 0; i < len(names); i += maxInList {
+		chunk := names[i:]
+		if len(chunk) > maxInList {
+			chunk = chunk[:maxInList]
+		}
+		var binds []string
+		var args []interface{}
+		for j, name := range chunk {
+			binds = append(binds, s.placeholder(j+1))
+			args = append(args, name)
+		}
+		q := "SELECT " + strings.Join(columns, ", ") + " FROM " + s.table.Name + " WHERE " + s.table.FileColumn + " IN (" + strings.Join(binds, ", ") + ")"
+		if err := s.each(q, args, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) each(q string, args []interface{}, fn func(*sql.Rows) error) error {
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) Missing(names []string) ([]string, error) {
+	found := make(map[string]bool)
+	err := s.query([]string{s.table.FileColumn}, names, func(rows *sql.Rows) error {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		found[name] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, name := range names {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
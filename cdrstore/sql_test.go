@@ -0,0 +1,265 @@
+package cdrstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeConn records the statements prepared on it, execerConn the ones run
+// through ExecContext
+type fakeConn struct {
+	ran []string
+}
+
+func (c *fakeConn) Prepare(q string) (driver.Stmt, error) {
+	return &fakeStmt{c: c, q: q}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+
+type execerConn struct{ *fakeConn }
+
+func (c execerConn) ExecContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Result, error) {
+	c.ran = append(c.ran, "exec "+q)
+	return driver.RowsAffected(0), nil
+}
+
+type fakeStmt struct {
+	c *fakeConn
+	q string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return 0 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.ran = append(s.c.ran, "prepared "+s.q)
+	return driver.RowsAffected(0), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("no queries")
+}
+
+type fakeConnector struct{ conn driver.Conn }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return c.conn, nil }
+func (c fakeConnector) Driver() driver.Driver                        { return nil }
+
+func TestSessionTimeZone(t *testing.T) {
+	hk, err := time.LoadLocation("Asia/Hong_Kong")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		backend string
+		want    string
+	}{
+		{"oracle", "ALTER SESSION SET TIME_ZONE = 'Asia/Hong_Kong'"},
+		{"postgres", "SET TIME ZONE 'Asia/Hong_Kong'"},
+		{"sqlite", ""},
+	}
+	for _, tt := range tests {
+		s := &sqlStore{backend: tt.backend, opts: Options{TimeZone: "Asia/Hong_Kong"}, loc: hk}
+		if got := s.sessionTimeZone(); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.backend, got, tt.want)
+		}
+	}
+	s := &sqlStore{backend: "oracle"}
+	if got := s.sessionTimeZone(); got != "" {
+		t.Errorf("without a time zone: %q", got)
+	}
+}
+
+func TestSessionConnector(t *testing.T) {
+	q := "SET TIME ZONE 'Asia/Hong_Kong'"
+
+	prepared := &fakeConn{}
+	c := &sessionConnector{Connector: fakeConnector{prepared}, init: q}
+	if _, err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(prepared.ran) != 1 || prepared.ran[0] != "prepared "+q {
+		t.Errorf("ran %q", prepared.ran)
+	}
+
+	exec := &fakeConn{}
+	c = &sessionConnector{Connector: fakeConnector{execerConn{exec}}, init: q}
+	if _, err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(exec.ran) != 1 || exec.ran[0] != "exec "+q {
+		t.Errorf("ran %q", exec.ran)
+	}
+}
+
+func testTable(backend string) Table {
+	now := "SYSDATE"
+	if backend != "oracle" {
+		now = "CURRENT_TIMESTAMP"
+	}
+	return Table{
+		Name:    "LOG",
+		Columns: []string{"GW_TYPE", "FILE_NAME", "MIN_TIME", "MAX_TIME", "CREATE_TIME", "VERSION"},
+		Values:  []string{"gwtype", "filename", "begin", "end", now, "version"},
+		Key:     []string{"gwtype", "filename"},
+	}
+}
+
+func TestStatement(t *testing.T) {
+	const (
+		oracleRows   = "SELECT :1 v0, :2 v1, :3 v2, :4 v3, :5 v5 FROM DUAL UNION ALL SELECT :6 v0, :7 v1, :8 v2, :9 v3, :10 v5 FROM DUAL"
+		pgInsert     = "INSERT INTO LOG (GW_TYPE, FILE_NAME, MIN_TIME, MAX_TIME, CREATE_TIME, VERSION) VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP, $5), ($6, $7, $8, $9, CURRENT_TIMESTAMP, $10)"
+		sqliteInsert = "INSERT INTO LOG (GW_TYPE, FILE_NAME, MIN_TIME, MAX_TIME, CREATE_TIME, VERSION) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, ?), (?, ?, ?, ?, CURRENT_TIMESTAMP, ?)"
+		update       = " ON CONFLICT (GW_TYPE, FILE_NAME) DO UPDATE SET MIN_TIME = excluded.MIN_TIME, MAX_TIME = excluded.MAX_TIME"
+		nothing      = " ON CONFLICT (GW_TYPE, FILE_NAME) DO NOTHING"
+	)
+	tests := []struct {
+		backend, conflict string
+		want              string
+	}{
+		{"oracle", "overwrite", "MERGE INTO LOG t USING (" + oracleRows + ") r ON (t.GW_TYPE = r.v0 AND t.FILE_NAME = r.v1)" +
+			" WHEN MATCHED THEN UPDATE SET t.MIN_TIME = r.v2, t.MAX_TIME = r.v3" +
+			" WHEN NOT MATCHED THEN INSERT (GW_TYPE, FILE_NAME, MIN_TIME, MAX_TIME, CREATE_TIME, VERSION) VALUES (r.v0, r.v1, r.v2, r.v3, SYSDATE, r.v5)"},
+		{"oracle", "keep", "MERGE INTO LOG t USING (" + oracleRows + ") r ON (t.GW_TYPE = r.v0 AND t.FILE_NAME = r.v1)" +
+			" WHEN NOT MATCHED THEN INSERT (GW_TYPE, FILE_NAME, MIN_TIME, MAX_TIME, CREATE_TIME, VERSION) VALUES (r.v0, r.v1, r.v2, r.v3, SYSDATE, r.v5)"},
+		{"oracle", "version", "INSERT INTO LOG (GW_TYPE, FILE_NAME, MIN_TIME, MAX_TIME, CREATE_TIME, VERSION) SELECT r.v0, r.v1, r.v2, r.v3, SYSDATE, r.v5 FROM (" + oracleRows + ") r"},
+		{"postgres", "overwrite", pgInsert + update},
+		{"postgres", "keep", pgInsert + nothing},
+		{"postgres", "version", pgInsert},
+		{"sqlite", "overwrite", sqliteInsert + update},
+		{"sqlite", "keep", sqliteInsert + nothing},
+		{"sqlite", "version", sqliteInsert},
+	}
+	for _, tt := range tests {
+		s := &sqlStore{backend: tt.backend, opts: Options{Conflict: tt.conflict}, table: testTable(tt.backend)}
+		if err := s.prepare(); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.statement(2); got != tt.want {
+			t.Errorf("%s %s:\n%s\nwant\n%s", tt.backend, tt.conflict, got, tt.want)
+		}
+	}
+}
+
+// Without columns the values are inserted in table order, SQL expressions
+// stay out of the rows selected from DUAL
+func TestStatementPositional(t *testing.T) {
+	s := &sqlStore{backend: "oracle", opts: Options{Conflict: "overwrite"}, table: Table{
+		Name:   "LOG",
+		Values: []string{"seq.nextval", "gwtype", "filename", "begin", "end", "SYSDATE", "null"},
+	}}
+	if err := s.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	want := "INSERT INTO LOG SELECT seq.nextval, r.v1, r.v2, r.v3, r.v4, SYSDATE, null FROM (SELECT :1 v1, :2 v2, :3 v3, :4 v4 FROM DUAL) r"
+	if got := s.statement(1); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if n := len(s.args(&Record{})); n != 4 {
+		t.Errorf("%d bind values, want 4", n)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	tests := []struct {
+		name     string
+		conflict string
+		table    Table
+	}{
+		{"no values", "overwrite", Table{Name: "LOG"}},
+		{"columns and values differ", "overwrite", Table{Name: "LOG", Columns: []string{"A"}, Values: []string{"gwtype", "filename"}}},
+		{"key without columns", "overwrite", Table{Name: "LOG", Values: []string{"gwtype", "filename"}, Key: []string{"filename"}}},
+		{"key not written", "overwrite", Table{Name: "LOG", Columns: []string{"A"}, Values: []string{"gwtype"}, Key: []string{"filename"}}},
+		{"version not written", "version", Table{Name: "LOG", Columns: []string{"A", "B", "C"}, Values: []string{"filename", "begin", "end"}, Key: []string{"filename"}}},
+	}
+	for _, tt := range tests {
+		s := &sqlStore{backend: "oracle", opts: Options{Conflict: tt.conflict}, table: tt.table}
+		if err := s.prepare(); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+// TestSQLite runs the statements of every policy on a SQLite database
+func TestSQLite(t *testing.T) {
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		conflict string
+		want     []string // FILE_NAME VERSION MIN_TIME MAX_TIME
+	}{
+		{"overwrite", []string{"a 1 01:00 03:00", "b 1 01:00 02:00"}},
+		{"keep", []string{"a 1 01:00 02:00", "b 1 01:00 02:00"}},
+		{"version", []string{"a 1 01:00 02:00", "a 2 01:00 03:00", "b 1 01:00 02:00"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.conflict, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "log.db")
+			db, err := sql.Open("sqlite", file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			key := "GW_TYPE, FILE_NAME"
+			if tt.conflict == "version" {
+				key += ", VERSION"
+			}
+			for _, q := range []string{
+				"CREATE TABLE LOG (GW_TYPE INTEGER, FILE_NAME TEXT, MIN_TIME DATETIME, MAX_TIME DATETIME, CREATE_TIME DATETIME, VERSION INTEGER)",
+				"CREATE UNIQUE INDEX LOG_UK ON LOG (" + key + ")",
+			} {
+				if _, err := db.Exec(q); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err := Open(Options{Backend: "sqlite", File: file, Conflict: tt.conflict}, testTable("sqlite"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			record := func(name string, end int) *Record {
+				return &Record{GwType: 1, FileName: name, Begin: day.Add(time.Hour), End: day.Add(time.Duration(end) * time.Hour)}
+			}
+			if err := s.Log(record("a", 2), record("b", 2)); err != nil {
+				t.Fatal(err)
+			}
+			// b again with the same times, a with others
+			if err := s.Log(record("a", 3), record("b", 2)); err != nil {
+				t.Fatal(err)
+			}
+
+			rows, err := db.Query("SELECT FILE_NAME, VERSION, MIN_TIME, MAX_TIME FROM LOG ORDER BY FILE_NAME, VERSION")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var got []string
+			for rows.Next() {
+				var name string
+				var version int
+				var begin, end time.Time
+				if err := rows.Scan(&name, &version, &begin, &end); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, fmt.Sprintf("%s %d %s %s", name, version, begin.Format("15:04"), end.Format("15:04")))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("rows\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+
+			missing, err := s.Missing([]string{"a", "c", "b"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(missing) != 1 || missing[0] != "c" {
+				t.Errorf("missing %v, want [c]", missing)
+			}
+		})
+	}
+}
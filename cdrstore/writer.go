@@ -0,0 +1,352 @@
+package cdrstore
+
+import (
+	"bufio"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrClosed is returned by Log once the Writer is closed
+var ErrClosed = errors.New("cdrstore: writer closed")
+
+type BatchOptions struct {
+	// Records written at once, default 100
+	Size int
+
+	// Write the pending records after this many seconds even if the batch
+	// isn't full, default 5
+	FlushSeconds int
+
+	// Records that can't be written while the database is unreachable are
+	// appended to this file and written again later, before any newer
+	// record. When empty they are dropped with an error.
+	SpoolFile string
+
+	// Records the database refuses, e.g. with a value too large for a
+	// column, are appended to this file instead of being retried, default
+	// the spool file with ".rejected" appended
+	RejectFile string
+
+	// Seconds between two attempts to write the spooled records, default 60
+	ReplaySeconds int
+}
+
+// Writer is a Store which writes the records in batches in the background,
+// Log only queues them
+type Writer struct {
+	store   Store
+	opts    BatchOptions
+	records chan *Record
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	// Records in the spool file, new batches are appended to it while it
+	// has some so they don't get written before older records
+	spooled int
+}
+
+// NewWriter starts writing to store, it must be closed to write the pending records
+func NewWriter(store Store, opts BatchOptions) *Writer {
+	if opts.Size <= 0 {
+		opts.Size = 100
+	}
+	if opts.FlushSeconds <= 0 {
+		opts.FlushSeconds = 5
+	}
+	if opts.ReplaySeconds <= 0 {
+		opts.ReplaySeconds = 60
+	}
+	if len(opts.RejectFile) == 0 && len(opts.SpoolFile) > 0 {
+		opts.RejectFile = opts.SpoolFile + ".rejected"
+	}
+	w := &Writer{
+		store:   store,
+		opts:    opts,
+		records: make(chan *Record, opts.Size*10),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Log queues the records, it fails with ErrClosed after Close
+func (w *Writer) Log(records ...*Record) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+	for _, r := range records {
+		if r.Logged.IsZero() {
+			r.Logged = time.Now()
+		}
+		w.records <- r
+	}
+	return nil
+}
+
+func (w *Writer) Missing(names []string) ([]string, error) {
+	return w.store.Missing(names)
+}
+
+// Close writes the pending records and closes the store. The goroutines
+// logging records should be stopped first, their records are refused after.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.closed = true
+	close(w.records)
+	w.mu.Unlock()
+	<-w.done
+	return w.store.Close()
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	flush := time.NewTicker(time.Duration(w.opts.FlushSeconds) * time.Second)
+	defer flush.Stop()
+	replay := time.NewTicker(time.Duration(w.opts.ReplaySeconds) * time.Second)
+	defer replay.Stop()
+
+	// Records spooled before a restart are written first
+	w.replay()
+
+	var batch []*Record
+	for {
+		select {
+		case r, ok := <-w.records:
+			if !ok {
+				if w.spooled > 0 {
+					w.replay()
+				}
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= w.opts.Size {
+				w.flush(batch)
+				batch = nil
+			}
+		case <-flush.C:
+			w.flush(batch)
+			batch = nil
+		case <-replay.C:
+			w.replay()
+		}
+	}
+}
+
+func (w *Writer) flush(batch []*Record) {
+	if len(batch) == 0 {
+		return
+	}
+	if w.spooled > 0 {
+		// Older records wait in the spool, the batch is written after them
+		w.spool(batch)
+		return
+	}
+	if rest := w.write(batch); len(rest) > 0 {
+		w.spool(rest)
+	}
+}
+
+// write writes the records in batches, and returns the ones left when the
+// database can't be reached. A batch failing for another reason is written
+// record by record, and the records which fail are rejected.
+func (w *Writer) write(records []*Record) []*Record {
+	for i := 0; i < len(records); i += w.opts.Size {
+		end := i + w.opts.Size
+		if end > len(records) {
+			end = len(records)
+		}
+		err := w.store.Log(records[i:end]...)
+		if err == nil {
+			continue
+		}
+		log.Println("ERROR", err)
+		if unreachable(err) {
+			return records[i:]
+		}
+		for j := i; j < end; j++ {
+			if err := w.store.Log(records[j]); err != nil {
+				if unreachable(err) {
+					log.Println("ERROR", err)
+					return records[j:]
+				}
+				w.reject(records[j], err)
+			}
+		}
+	}
+	return nil
+}
+
+// spool appends the records to the spool file
+func (w *Writer) spool(records []*Record) {
+	if len(w.opts.SpoolFile) == 0 {
+		log.Printf("ERROR Dropped %d loading log records, no spool file\n", len(records))
+		return
+	}
+	if err := appendSpool(w.opts.SpoolFile, records); err != nil {
+		log.Println("ERROR", err)
+		return
+	}
+	w.spooled += len(records)
+	log.Printf("Spooled %d loading log records to %s\n", len(records), w.opts.SpoolFile)
+}
+
+// reject appends a record the database refused to the reject file
+func (w *Writer) reject(r *Record, err error) {
+	log.Printf("ERROR Rejected the loading log record of %s: %s\n", r.FileName, err)
+	if len(w.opts.RejectFile) == 0 {
+		return
+	}
+	if err := appendSpool(w.opts.RejectFile, []*Record{r}); err != nil {
+		log.Println("ERROR", err)
+	}
+}
+
+// replay writes the spooled records to the store, the ones left while the
+// database can't be reached stay in the spool file
+func (w *Writer) replay() {
+	var records []*Record
+	err := readSpool(w.opts.SpoolFile, func(r *Record) {
+		records = append(records, r)
+	})
+	if err != nil {
+		log.Println("ERROR", err)
+		return
+	}
+	w.spooled = len(records)
+	if len(records) == 0 {
+		return
+	}
+
+	rest := w.write(records)
+	written := len(records) - len(rest)
+	if written == 0 {
+		return
+	}
+	log.Printf("Replayed %d spooled loading log records\n", written)
+	if len(rest) == 0 {
+		os.Remove(w.opts.SpoolFile)
+		w.spooled = 0
+		return
+	}
+
+	// Keep the rest, the spool file is only written by this goroutine
+	tmp := w.opts.SpoolFile + ".tmp"
+	os.Remove(tmp)
+	if err := appendSpool(tmp, rest); err != nil {
+		log.Println("ERROR", err)
+		return
+	}
+	if err := os.Rename(tmp, w.opts.SpoolFile); err != nil {
+		log.Println("ERROR", err)
+		return
+	}
+	w.spooled = len(rest)
+}
+
+// Oracle errors about the connection or the instance rather than the records
+var oracleUnreachable = []string{
+	"ORA-00018", "ORA-00020", "ORA-01033", "ORA-01034", "ORA-01089", "ORA-01092",
+	"ORA-03113", "ORA-03114", "ORA-03135", "ORA-12170", "ORA-12514", "ORA-12516",
+	"ORA-12518", "ORA-12519", "ORA-12520", "ORA-12528", "ORA-12537", "ORA-12541",
+	"ORA-12543", "ORA-12547",
+}
+
+// unreachable reports whether an error is about reaching the database rather
+// than about the records, so writing them again later may work
+func unreachable(err error) bool {
+	for _, e := range []error{driver.ErrBadConn, sql.ErrConnDone, io.EOF, io.ErrUnexpectedEOF,
+		syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EPIPE, syscall.ENOSPC} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Connection exceptions, too many connections, and the server
+		// shutting down or starting
+		switch code := string(pqErr.Code); code {
+		case "53300", "57P01", "57P02", "57P03":
+			return true
+		default:
+			return strings.HasPrefix(code, "08")
+		}
+	}
+	msg := err.Error()
+	for _, code := range oracleUnreachable {
+		if strings.Contains(msg, code) {
+			return true
+		}
+	}
+	// SQLite busy with another writer
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "SQLITE_BUSY")
+}
+
+func appendSpool(name string, records []*Record) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readSpool calls fn with every record of a file of JSON lines
+func readSpool(name string, fn func(*Record)) error {
+	if len(name) == 0 {
+		return nil
+	}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// Skip a line cut short by a crash
+			continue
+		}
+		fn(&r)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,177 @@
+package cdrstore
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeStore fails while down, and refuses the records named "bad"
+type fakeStore struct {
+	down   bool
+	logged []string
+}
+
+func (s *fakeStore) Log(records ...*Record) error {
+	if s.down {
+		return driver.ErrBadConn
+	}
+	for _, r := range records {
+		if r.FileName == "bad" {
+			return errors.New("ORA-12899: value too large for column")
+		}
+	}
+	for _, r := range records {
+		s.logged = append(s.logged, r.FileName)
+	}
+	return nil
+}
+
+func (s *fakeStore) Missing(names []string) ([]string, error) { return nil, nil }
+func (s *fakeStore) Close() error                             { return nil }
+
+func names(records []*Record) string {
+	var n []string
+	for _, r := range records {
+		n = append(n, r.FileName)
+	}
+	return strings.Join(n, " ")
+}
+
+func batch(names ...string) []*Record {
+	var records []*Record
+	for _, n := range names {
+		records = append(records, &Record{FileName: n})
+	}
+	return records
+}
+
+func spooled(t *testing.T, name string) string {
+	t.Helper()
+	var records []*Record
+	if err := readSpool(name, func(r *Record) { records = append(records, r) }); err != nil {
+		t.Fatal(err)
+	}
+	return names(records)
+}
+
+// newTestWriter returns a Writer whose batches are flushed by the test
+func newTestWriter(t *testing.T, store Store) *Writer {
+	dir := t.TempDir()
+	return &Writer{store: store, opts: BatchOptions{
+		Size:       2,
+		SpoolFile:  filepath.Join(dir, "spool"),
+		RejectFile: filepath.Join(dir, "rejected"),
+	}}
+}
+
+func TestWriterRejects(t *testing.T) {
+	s := &fakeStore{}
+	w := newTestWriter(t, s)
+	w.flush(batch("a", "bad", "b", "c", "d"))
+
+	if got := strings.Join(s.logged, " "); got != "a b c d" {
+		t.Errorf("logged %s, want a b c d", got)
+	}
+	if got := spooled(t, w.opts.RejectFile); got != "bad" {
+		t.Errorf("rejected %s, want bad", got)
+	}
+	if w.spooled != 0 {
+		t.Errorf("%d records spooled", w.spooled)
+	}
+}
+
+func TestWriterSpoolsInOrder(t *testing.T) {
+	s := &fakeStore{down: true}
+	w := newTestWriter(t, s)
+	w.flush(batch("a", "b", "c"))
+	if got := spooled(t, w.opts.SpoolFile); got != "a b c" {
+		t.Fatalf("spooled %s, want a b c", got)
+	}
+
+	// Back up, the new batch waits for the spooled records
+	s.down = false
+	w.flush(batch("d"))
+	if len(s.logged) > 0 {
+		t.Errorf("logged %v before the spool", s.logged)
+	}
+	w.replay()
+	if got := strings.Join(s.logged, " "); got != "a b c d" {
+		t.Errorf("logged %s, want a b c d", got)
+	}
+	if got := spooled(t, w.opts.SpoolFile); got != "" {
+		t.Errorf("spool still has %s", got)
+	}
+
+	w.flush(batch("e"))
+	if got := strings.Join(s.logged, " "); got != "a b c d e" {
+		t.Errorf("logged %s, want a b c d e", got)
+	}
+}
+
+func TestWriterReplayKeepsTheRest(t *testing.T) {
+	s := &fakeStore{}
+	w := newTestWriter(t, s)
+	if err := appendSpool(w.opts.SpoolFile, batch("a", "b", "bad", "c")); err != nil {
+		t.Fatal(err)
+	}
+	s.down = true
+	w.replay()
+	if w.spooled != 4 {
+		t.Errorf("%d records spooled, want 4", w.spooled)
+	}
+	s.down = false
+	w.replay()
+	if got := strings.Join(s.logged, " "); got != "a b c" {
+		t.Errorf("logged %s, want a b c", got)
+	}
+	if got := spooled(t, w.opts.RejectFile); got != "bad" {
+		t.Errorf("rejected %s, want bad", got)
+	}
+	if w.spooled != 0 {
+		t.Errorf("%d records spooled", w.spooled)
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	s := &fakeStore{}
+	w := NewWriter(s, BatchOptions{})
+	if err := w.Log(batch("a")...); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(s.logged, " "); got != "a" {
+		t.Errorf("logged %s, want a", got)
+	}
+	if err := w.Log(batch("b")...); err != ErrClosed {
+		t.Errorf("Log after Close = %v, want ErrClosed", err)
+	}
+	if err := w.Close(); err != ErrClosed {
+		t.Errorf("Close twice = %v, want ErrClosed", err)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("write: %w", syscall.ECONNRESET), true},
+		{errors.New("ORA-03113: end-of-file on communication channel"), true},
+		{errors.New("database is locked (5) (SQLITE_BUSY)"), true},
+		{errors.New("ORA-12899: value too large for column"), false},
+		{errors.New("pq: duplicate key value violates unique constraint"), false},
+	}
+	for _, tt := range tests {
+		if got := unreachable(tt.err); got != tt.want {
+			t.Errorf("unreachable(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Package decompress opens files which may be compressed with gzip, zstd,
+// bzip2 or Unix compress, so the tools can read archived files as they are.
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// Suffixes of the compressed files
+var exts = []string{".gz", ".zst", ".bz2", ".Z"}
+
+var (
+	magicGzip     = []byte{0x1f, 0x8b}
+	magicZstd     = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicBzip2    = []byte("BZh")
+	magicCompress = []byte{0x1f, 0x9d}
+)
+
+// TrimExt returns the name without its compression suffix
+func TrimExt(name string) string {
+	for _, ext := range exts {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// Open opens the file for reading, decompressing it if needed
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f, path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewReader decompresses r by the magic bytes of its content or, when they're
+// not conclusive, the suffix of name. Closing the reader closes r if it's an
+// io.Closer.
+func NewReader(r io.Reader, name string) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(4)
+
+	format := ""
+	switch {
+	case bytes.HasPrefix(head, magicGzip):
+		format = ".gz"
+	case bytes.HasPrefix(head, magicZstd):
+		format = ".zst"
+	case bytes.HasPrefix(head, magicCompress):
+		format = ".Z"
+	case bytes.HasPrefix(head, magicBzip2) && strings.HasSuffix(name, ".bz2"):
+		// "BZh" may well be the start of a text file
+		format = ".bz2"
+	case len(head) == 0:
+	default:
+		if strings.HasSuffix(name, ".bz2") {
+			format = ".bz2"
+		}
+	}
+
+	var dr io.Reader
+	var closeFn func() error
+	switch format {
+	case ".gz":
+		zr, err := pgzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		dr, closeFn = zr, zr.Close
+	case ".zst":
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		dr, closeFn = zr, func() error {
+			zr.Close()
+			return nil
+		}
+	case ".bz2":
+		dr = bzip2.NewReader(br)
+	case ".Z":
+		zr, err := newLZWReader(br)
+		if err != nil {
+			return nil, err
+		}
+		dr = zr
+	default:
+		dr = br
+	}
+	return &readCloser{Reader: dr, closeFn: closeFn, src: r}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closeFn func() error
+	src     io.Reader
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	if r.closeFn != nil {
+		err = r.closeFn()
+	}
+	if c, ok := r.src.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
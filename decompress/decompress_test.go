@@ -0,0 +1,127 @@
+package decompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const plain = "a|20220101000000|x\nb|20220101000001|y\n"
+
+// bzip2 has no writer in the standard library, this is plain compressed by
+// Python's bz2 module
+const plainBzip2 = "425a6839314159265359fed8222c00000ec980301070003000006420003100d34d02547a4d31a41988e7c28104a1905886dde8bb9229c28487f6c11160"
+
+func gzipped(t *testing.T, s string) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(s))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func zstded(t *testing.T, s string) []byte {
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	return w.EncodeAll([]byte(s), nil)
+}
+
+// closer records whether the source was closed
+type closer struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestNewReader(t *testing.T) {
+	bz, _ := hex.DecodeString(plainBzip2)
+	compressed, err := os.ReadFile(filepath.Join("testdata", "bits12.Z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"x.gz", gzipped(t, plain), plain},
+		{"x", gzipped(t, plain), plain}, // by the magic bytes
+		{"x.csv", zstded(t, plain), plain},
+		{"x.zst", zstded(t, plain), plain},
+		{"x.bz2", bz, plain},
+		{"x", bz, string(bz)}, // "BZh" may start a text file, the suffix decides
+		{"x.Z", compressed, string(text(30000))},
+		{"x.gz", []byte(plain), plain}, // not compressed whatever its suffix
+		{"BZh.txt", []byte("BZh is a text\n"), "BZh is a text\n"},
+		{"x", []byte("a"), "a"},
+		{"x.gz", nil, ""},
+	}
+	for _, tt := range tests {
+		src := &closer{Reader: bytes.NewReader(tt.data)}
+		r, err := NewReader(src, tt.name)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: read %d bytes, %v, want %d", tt.name, len(got), err, len(tt.want))
+		}
+		if err := r.Close(); err != nil || !src.closed {
+			t.Errorf("%s: Close %v, source closed %t", tt.name, err, src.closed)
+		}
+	}
+
+	// Corrupt headers are errors
+	for name, data := range map[string][]byte{"gzip": {0x1f, 0x8b, 0, 0}, "zstd": {0x28, 0xb5, 0x2f, 0xfd, 0xff}} {
+		r, err := NewReader(bytes.NewReader(data), "x")
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+		if err == nil {
+			t.Errorf("corrupt %s read", name)
+		}
+	}
+}
+
+func TestTrimExt(t *testing.T) {
+	for name, want := range map[string]string{"a.gz": "a", "a.csv.zst": "a.csv", "a.bz2": "a", "a.Z": "a", "a.z": "a.z", "a.gz.txt": "a.gz.txt", "a": "a"} {
+		if got := TrimExt(name); got != want {
+			t.Errorf("TrimExt(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "x.gz")
+	if err := os.WriteFile(name, gzipped(t, plain), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, err := io.ReadAll(r); err != nil || string(got) != plain {
+		t.Errorf("read %q, %v", got, err)
+	}
+	if _, err := Open(name + ".none"); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package decompress
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// The LZW variant of Unix compress (.Z) isn't the one of compress/lzw: code
+// widths grow from 9 bits up to the maximum in the header, a clear code
+// resets the table in block mode, and the codes are written in groups of 8,
+// so the rest of a group is skipped whenever the width changes.
+
+var ErrCorrupt = errors.New("decompress: corrupt .Z data")
+
+const (
+	lzwInitBits  = 9
+	lzwClear     = 256
+	lzwBlockMode = 0x80
+	lzwBitsMask  = 0x1f
+)
+
+type lzwReader struct {
+	r *bufio.Reader
+
+	// Bit input, LSB first
+	acc   uint32
+	nbits uint
+	codes int // codes read at the current width since the last reset
+
+	maxBits   uint
+	blockMode bool
+	width     uint
+	maxCode   int
+	maxMax    int
+	free      int
+
+	prefix []int
+	suffix []byte
+	old    int
+	fin    byte
+
+	stack []byte // decoded string, reversed
+	out   []byte // output not read yet
+	eof   bool
+}
+
+func newLZWReader(r *bufio.Reader) (*lzwReader, error) {
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, ErrCorrupt
+	}
+	if head[0] != magicCompress[0] || head[1] != magicCompress[1] {
+		return nil, ErrCorrupt
+	}
+	z := &lzwReader{
+		r:         r,
+		maxBits:   uint(head[2] & lzwBitsMask),
+		blockMode: head[2]&lzwBlockMode != 0,
+		old:       -1,
+	}
+	if z.maxBits < lzwInitBits || z.maxBits > 16 {
+		return nil, ErrCorrupt
+	}
+	z.maxMax = 1 << z.maxBits
+	z.prefix = make([]int, z.maxMax)
+	z.suffix = make([]byte, z.maxMax)
+	for i := 0; i < 256; i++ {
+		z.suffix[i] = byte(i)
+	}
+	z.setWidth(lzwInitBits)
+	z.free = 256
+	if z.blockMode {
+		z.free = 257
+	}
+	return z, nil
+}
+
+// setWidth changes the code width. The 9 bit codes are never limited by the
+// table size, as in compress itself, so with a maximum of 9 bits the width
+// still grows to 10 once the table is full.
+func (z *lzwReader) setWidth(width uint) {
+	z.width = width
+	if width == z.maxBits && width > lzwInitBits {
+		z.maxCode = z.maxMax
+	} else {
+		z.maxCode = 1<<width - 1
+	}
+}
+
+// skipGroup drops the rest of the current group of 8 codes
+func (z *lzwReader) skipGroup() {
+	if rest := (8 - z.codes%8) % 8; rest > 0 {
+		for i := 0; i < rest; i++ {
+			if _, ok := z.readCode(); !ok {
+				break
+			}
+		}
+	}
+	z.codes = 0
+}
+
+// readCode reads a code of the current width, ok is false at the end of the data
+func (z *lzwReader) readCode() (int, bool) {
+	for z.nbits < z.width {
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return 0, false
+		}
+		z.acc |= uint32(b) << z.nbits
+		z.nbits += 8
+	}
+	code := int(z.acc & (1<<z.width - 1))
+	z.acc >>= z.width
+	z.nbits -= z.width
+	z.codes++
+	return code, true
+}
+
+func (z *lzwReader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.eof {
+			return 0, io.EOF
+		}
+		if err := z.decode(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// decode decodes the next code into out
+func (z *lzwReader) decode() error {
+	if z.free > z.maxCode {
+		z.skipGroup()
+		z.setWidth(z.width + 1)
+	}
+	code, ok := z.readCode()
+	if !ok {
+		// The last code is followed by less than a byte of padding, more
+		// means a code was cut short
+		if z.nbits >= 8 {
+			return io.ErrUnexpectedEOF
+		}
+		z.eof = true
+		return nil
+	}
+
+	if z.old == -1 {
+		if code >= 256 {
+			return ErrCorrupt
+		}
+		z.old = code
+		z.fin = byte(code)
+		z.out = append(z.out[:0], z.fin)
+		return nil
+	}
+	if code == lzwClear && z.blockMode {
+		for i := range z.prefix {
+			z.prefix[i] = 0
+		}
+		z.free = 256
+		z.skipGroup()
+		z.setWidth(lzwInitBits)
+		return nil
+	}
+
+	in := code
+	z.stack = z.stack[:0]
+	if code >= z.free {
+		// The code being defined, the previous string and its first byte
+		if code > z.free {
+			return ErrCorrupt
+		}
+		z.stack = append(z.stack, z.fin)
+		code = z.old
+	}
+	for code >= 256 {
+		z.stack = append(z.stack, z.suffix[code])
+		code = z.prefix[code]
+	}
+	z.fin = z.suffix[code]
+	z.stack = append(z.stack, z.fin)
+
+	z.out = z.out[:0]
+	for i := len(z.stack) - 1; i >= 0; i-- {
+		z.out = append(z.out, z.stack[i])
+	}
+
+	if z.free < z.maxMax {
+		z.prefix[z.free] = z.old
+		z.suffix[z.free] = z.fin
+		z.free++
+	}
+	z.old = in
+	return nil
+}
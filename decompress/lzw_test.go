@@ -0,0 +1,127 @@
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// text returns the n bytes compressed into the files of testdata, short
+// strings over a small alphabet so the tables fill up quickly
+func text(n int) []byte {
+	const alphabet = "0123456789|,\nABCDEF"
+	b := make([]byte, n)
+	x := uint32(1)
+	for i := range b {
+		x = x*1103515245 + 12345
+		b[i] = alphabet[(x>>16)%uint32(len(alphabet))]
+	}
+	return b
+}
+
+// The files were written by an encoder following ncompress, which fills the
+// table and, for the -clear files, resets it with a clear code as soon as
+// it's full, and checked with gzip -d
+var lzwFiles = []struct {
+	name string
+	size int
+}{
+	{"bits9.Z", 6000},
+	{"bits9-clear.Z", 20000},
+	{"bits12.Z", 30000},
+	{"bits12-clear.Z", 60000},
+	{"bits16.Z", 30000},
+	{"bits16-clear.Z", 260000},
+}
+
+func TestLZW(t *testing.T) {
+	for _, f := range lzwFiles {
+		t.Run(f.name, func(t *testing.T) {
+			r, err := Open(filepath.Join("testdata", f.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := text(f.size); !bytes.Equal(got, want) {
+				t.Errorf("%d bytes differ from the %d expected, from byte %d", len(got), len(want), firstDiff(got, want))
+			}
+		})
+	}
+}
+
+func firstDiff(a, b []byte) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	return len(a)
+}
+
+func TestLZWTruncated(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "bits12.Z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := text(30000)
+
+	// Cut inside a code is an error, cut at the end of a code can't be told
+	// from the end of the data. Either way the output is the start of the text.
+	cutShort := 0
+	for n := 3; n < len(data); n += 997 {
+		r, err := NewReader(bytes.NewReader(data[:n]), "x.Z")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err == io.ErrUnexpectedEOF {
+			cutShort++
+		} else if err != nil {
+			t.Errorf("cut at %d: %v", n, err)
+		}
+		if !bytes.HasPrefix(want, got) {
+			t.Errorf("cut at %d: output differs from byte %d", n, firstDiff(got, want))
+		}
+	}
+	if cutShort == 0 {
+		t.Error("no cut code found")
+	}
+
+	for _, head := range [][]byte{data[:2], {0x1f, 0x9d, 0x80 | 8}, {0x1f, 0x9d, 0x80 | 17}} {
+		if _, err := newLZWReader(bufio.NewReader(bytes.NewReader(head))); err != ErrCorrupt {
+			t.Errorf("header %x: %v, want ErrCorrupt", head, err)
+		}
+	}
+}
+
+func TestLZWCorrupt(t *testing.T) {
+	// The first code must be a byte, then a code can't be beyond the next one
+	for _, codes := range [][]int{{300}, {65, 300}} {
+		var b []byte
+		acc, nbits := uint32(0), uint(0)
+		for _, c := range codes {
+			acc |= uint32(c) << nbits
+			nbits += 9
+			for nbits >= 8 {
+				b = append(b, byte(acc))
+				acc >>= 8
+				nbits -= 8
+			}
+		}
+		b = append(b, byte(acc))
+		r, err := NewReader(bytes.NewReader(append([]byte{0x1f, 0x9d, 0x80 | 12}, b...)), "x.Z")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); err != ErrCorrupt {
+			t.Errorf("codes %v: %v, want ErrCorrupt", codes, err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Package dedup finds the lines of a report which are in other report files
+// already. The wildcard token in a report line matches any text, e.g. any
+// value of a column.
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"index/suffixarray"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type Options struct {
+	// Token matching any text, default "OTHER"
+	Wildcard string
+
+	// Characters escaped in the report lines before they're used as regular
+	// expressions by the Regex matcher, e.g. "?"
+	Quote string
+}
+
+func (o *Options) defaults() {
+	if len(o.Wildcard) == 0 {
+		o.Wildcard = "OTHER"
+	}
+}
+
+// Matcher tells whether a report line is in the scanned files
+type Matcher interface {
+	Contains(line string) (bool, error)
+}
+
+// Index holds the lines of the scanned files in memory with a suffix array,
+// so a lookup costs a search of the longest text between the wildcards of
+// the line whatever the number of files.
+//
+// It finds the same lines as Regex: a line of the files matches when it
+// holds the texts between the wildcards in order, anywhere in the line. The
+// texts are taken literally though, where Regex reads "." or "?" in them as
+// regular expressions and fails on "+852...".
+type Index struct {
+	opts  Options
+	data  []byte // the lines, each ended with a '\n'
+	lines int
+	sa    *suffixarray.Index
+}
+
+// NewIndex reads the files into an index
+func NewIndex(files []string, opts Options) (*Index, error) {
+	opts.defaults()
+	x := &Index{opts: opts}
+	for _, file := range files {
+		if err := x.add(file); err != nil {
+			return nil, err
+		}
+	}
+	x.sa = suffixarray.New(x.data)
+	return x, nil
+}
+
+func (x *Index) add(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		x.data = append(x.data, scanner.Bytes()...)
+		x.data = append(x.data, '\n')
+		x.lines++
+	}
+	return scanner.Err()
+}
+
+// Len returns the number of lines in the index
+func (x *Index) Len() int {
+	return x.lines
+}
+
+// Contains reports whether a line of the files holds the texts between the
+// wildcards of the report line in order
+func (x *Index) Contains(line string) (bool, error) {
+	texts := strings.Split(line, x.opts.Wildcard)
+	longest := ""
+	for _, t := range texts {
+		if len(t) > len(longest) {
+			longest = t
+		}
+	}
+	if len(longest) == 0 {
+		// Only wildcards, any line matches
+		return x.lines > 0, nil
+	}
+	if len(texts) == 1 {
+		return len(x.sa.Lookup([]byte(longest), 1)) > 0, nil
+	}
+
+	// The lines holding the longest text are the candidates
+	checked := make(map[int]bool)
+	for _, off := range x.sa.Lookup([]byte(longest), -1) {
+		start := bytes.LastIndexByte(x.data[:off], '\n') + 1
+		if checked[start] {
+			continue
+		}
+		checked[start] = true
+		end := off + bytes.IndexByte(x.data[off:], '\n')
+		if holds(string(x.data[start:end]), texts) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// holds reports whether s has the texts in order, as the regular expression
+// of the texts joined with ".*" would match
+func holds(s string, texts []string) bool {
+	for _, t := range texts {
+		i := strings.Index(s, t)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(t):]
+	}
+	return true
+}
+
+// Compare asks both matchers and logs the lines they disagree on, the answer
+// is the one of A. A line B fails on counts as a disagreement.
+type Compare struct {
+	A, B  Matcher
+	Diffs int64
+}
+
+func (c *Compare) Contains(line string) (bool, error) {
+	a, err := c.A.Contains(line)
+	if err != nil {
+		return false, err
+	}
+	b, err := c.B.Contains(line)
+	if err != nil {
+		atomic.AddInt64(&c.Diffs, 1)
+		log.Printf("DIFF %t/%v: %s\n", a, err, line)
+		return a, nil
+	}
+	if a != b {
+		atomic.AddInt64(&c.Diffs, 1)
+		log.Printf("DIFF %t/%t: %s\n", a, b, line)
+	}
+	return a, nil
+}
@@ -0,0 +1,178 @@
+package dedup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes the files into a temporary directory and returns their paths
+func writeFiles(t *testing.T, files map[string]string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestIndexAndRegex(t *testing.T) {
+	files := writeFiles(t, map[string]string{
+		"scan1.csv": strings.Join([]string{
+			"85291234567,CSL,HK,20210528,5",
+			"85291234568,PCCW,HK,20210528,6",
+			"10a0b0c1,CSL,1",
+			"zzz,a",
+			"a?,1",
+		}, "\n") + "\n",
+		"scan2.csv": "There are 2 SMS CDRs in all.\n+85291234569,SMT,HK\n",
+	})
+
+	tests := []struct {
+		name      string
+		opts      Options
+		line      string
+		index     bool
+		regex     bool
+		regexFail bool
+	}{
+		// The engines agree
+		{name: "same line", line: "85291234567,CSL,HK,20210528,5", index: true, regex: true},
+		{name: "in another file", line: "85291234568,PCCW,HK,20210528,6", index: true, regex: true},
+		{name: "wildcard", line: "85291234567,OTHER,HK,20210528,5", index: true, regex: true},
+		{name: "wildcards", line: "85291234568,OTHER,OTHER,20210528,6", index: true, regex: true},
+		{name: "not there", line: "85291234570,CSL,HK,20210528,5", index: false, regex: false},
+		{name: "wildcard, other values", line: "85291234567,OTHER,HK,20210528,6", index: false, regex: false},
+		{name: "part of a line", line: "5291234567,CSL,HK", index: true, regex: true},
+		{name: "wildcard over columns", line: "85291234567,OTHER,5", index: true, regex: true},
+		{name: "wildcard first and last", line: "OTHER,PCCW,OTHER", index: true, regex: true},
+		{name: "texts out of order", line: "PCCW,OTHER,85291234568", index: false, regex: false},
+		{name: "wildcard in a value", line: "8529OTHER68,PCCW", index: true, regex: true},
+		{name: "only a wildcard", line: "OTHER", index: true, regex: true},
+		{name: "quoted", opts: Options{Quote: "?"}, line: "a?,1", index: true, regex: true},
+		{name: "other wildcard", opts: Options{Wildcard: "*"}, line: "85291234568,*,6", index: true, regex: true},
+
+		// The regex engine reads the metacharacters
+		{name: "dot in a value", line: "10.0.0.1,CSL,1", index: false, regex: true},
+		{name: "question mark not quoted", line: "zzzz?,a", index: false, regex: true},
+		{name: "plus in a value", line: "+85291234569,SMT,HK", index: true, regexFail: true},
+		{name: "parenthesis in a value", line: "a(b,x", index: false, regexFail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, err := NewIndex(files, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := x.Contains(tt.line); err != nil || got != tt.index {
+				t.Errorf("Index.Contains(%q) = %t, %v, want %t", tt.line, got, err, tt.index)
+			}
+
+			got, err := NewRegex(files, tt.opts).Contains(tt.line)
+			if tt.regexFail {
+				if err == nil {
+					t.Errorf("Regex.Contains(%q) = %t, want an error", tt.line, got)
+				}
+				return
+			}
+			if err != nil || got != tt.regex {
+				t.Errorf("Regex.Contains(%q) = %t, %v, want %t", tt.line, got, err, tt.regex)
+			}
+		})
+	}
+}
+
+func TestIndexEmpty(t *testing.T) {
+	x, err := NewIndex(writeFiles(t, map[string]string{"scan.csv": ""}), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"OTHER", "a,OTHER", "a"} {
+		if got, _ := x.Contains(line); got {
+			t.Errorf("Contains(%q) in no lines", line)
+		}
+	}
+}
+
+// reportLines returns n lines of an SMS report: MSISDN, operator, country,
+// date and count, with wildcards in some columns
+func reportLines(n int, seed uint32, wildcards bool) []string {
+	operators := []string{"CSL", "PCCW", "SMT", "HKT", "CMHK", "3HK"}
+	countries := []string{"HK", "MO", "CN", "SG"}
+	x := seed
+	next := func(m int) int {
+		x = x*1103515245 + 12345
+		return int(x>>16) % m
+	}
+	lines := make([]string, n)
+	for i := range lines {
+		cols := []string{
+			fmt.Sprintf("852%08d", 91230000+next(400)),
+			operators[next(len(operators))],
+			countries[next(len(countries))],
+			fmt.Sprintf("202105%02d", 1+next(28)),
+			fmt.Sprint(1 + next(20)),
+		}
+		if wildcards {
+			for c := range cols {
+				if next(5) == 0 {
+					cols[c] = "OTHER"
+				}
+			}
+		}
+		lines[i] = strings.Join(cols, ",")
+	}
+	return lines
+}
+
+// On the lines of real reports the index answers as the regular expressions
+func TestCompare(t *testing.T) {
+	scanned := reportLines(3000, 1, false)
+	files := writeFiles(t, map[string]string{
+		"CTK_IP_si_S_20210528.csv": strings.Join(scanned[:1500], "\n") + "\n\nThere are 1500 SMS CDRs in all.\n",
+		"CTK_IP_so_S_20210528.csv": strings.Join(scanned[1500:], "\n") + "\n",
+	})
+	x, err := NewIndex(files, Options{Quote: "?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Len() != 3002 {
+		t.Errorf("Len() = %d, want 3002", x.Len())
+	}
+
+	report := append(reportLines(2000, 2, true), scanned[:200]...)
+	report = append(report, "852912300,OTHER,20210528", "OTHER,CSL,OTHER", "There are 2 SMS CDRs in all.")
+	c := &Compare{A: x, B: NewRegex(files, Options{Quote: "?"})}
+	found := 0
+	for _, line := range report {
+		ok, err := c.Contains(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			found++
+		}
+	}
+	if c.Diffs != 0 {
+		t.Errorf("the engines disagree on %d lines", c.Diffs)
+	}
+	if found <= 200 || found == len(report) {
+		t.Errorf("%d lines of %d found, the report doesn't test much", found, len(report))
+	}
+
+	// A line the regular expressions fail on is a disagreement, answered by A
+	if got, err := c.Contains("+85291230001,CSL,HK"); err != nil || got {
+		t.Errorf("Contains(+852...) = %t, %v", got, err)
+	}
+	if c.Diffs != 1 {
+		t.Errorf("Diffs = %d, want 1", c.Diffs)
+	}
+}
@@ -0,0 +1,69 @@
+package dedup
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Regex is the matcher the report fixers had before the index: the report
+// line, its wildcards replaced with ".*", is a regular expression searched in
+// every line of the files. It reads all the files for every line.
+type Regex struct {
+	files []string
+	opts  Options
+}
+
+func NewRegex(files []string, opts Options) *Regex {
+	opts.defaults()
+	return &Regex{files: files, opts: opts}
+}
+
+// Contains reports whether a line of the files matches the report line
+func (r *Regex) Contains(line string) (bool, error) {
+	str := strings.Replace(line, r.opts.Wildcard, ".*", -1)
+	for _, c := range r.opts.Quote {
+		str = strings.Replace(str, string(c), "\\"+string(c), -1)
+	}
+	pat, err := regexp.Compile(str)
+	if err != nil {
+		return false, err
+	}
+
+	var wg sync.WaitGroup
+	found := make(chan bool, len(r.files))
+	wg.Add(len(r.files))
+	for _, file := range r.files {
+		go func(file string) {
+			defer wg.Done()
+			found <- grep(file, pat)
+		}(file)
+	}
+	wg.Wait()
+	close(found)
+	for ok := range found {
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// grep reports whether a line of the file matches, an unreadable file has none
+func grep(file string, reg *regexp.Regexp) bool {
+	fd, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+
+	bf := bufio.NewScanner(fd)
+	for bf.Scan() {
+		if reg.MatchString(bf.Text()) {
+			return true
+		}
+	}
+	return false
+}
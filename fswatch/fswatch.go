@@ -0,0 +1,343 @@
+// Package fswatch watches directory trees with fsnotify, adding watches for
+// directories created after startup and dropping the ones that are removed.
+// Trees on filesystems that don't deliver inotify events, like NFS, are polled.
+package fswatch
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ErrWatchLimit is returned when the inotify watch limit of the user is reached
+var ErrWatchLimit = errors.New("fswatch: inotify watch limit reached")
+
+// Files changed this long before the last event are reported again after a
+// queue overflow, to cover events still in the queue when it overflowed
+const rescanMargin = time.Minute
+
+type Options struct {
+	// Regular expressions on the path, when set only matching files are reported
+	Include []string
+
+	// Regular expressions on the path, matching files and directories are skipped
+	Exclude []string
+
+	// When to poll a tree instead of using inotify: "auto" for network
+	// filesystems (the default), "always" or "never"
+	Poll string
+
+	// Seconds between two polls, default 10
+	PollSeconds int
+}
+
+// Event is a file system event. Files found by walking a tree rather than
+// reported by inotify, e.g. in a new directory, after a queue overflow or by
+// polling, are reported as Create|CloseWrite with Scanned set.
+type Event struct {
+	fsnotify.Event
+
+	Scanned bool
+}
+
+// Watcher forwards the events of all watched trees. The creation of a
+// directory isn't forwarded, instead the files found in it when its watch is
+// added are reported, since they may have been written before the directory
+// was watched.
+type Watcher struct {
+	Events chan Event
+	Errors chan error
+
+	opts    Options
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+
+	w         *fsnotify.Watcher
+	mu        sync.Mutex
+	roots     map[string]bool
+	dirs      map[string]bool
+	pollers   map[string]chan struct{}
+	lastEvent time.Time
+	done      chan struct{}
+}
+
+func NewWatcher(opts Options) (*Watcher, error) {
+	watcher := &Watcher{
+		Events:  make(chan Event),
+		Errors:  make(chan error),
+		opts:    opts,
+		roots:   make(map[string]bool),
+		dirs:    make(map[string]bool),
+		pollers: make(map[string]chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if watcher.opts.PollSeconds <= 0 {
+		watcher.opts.PollSeconds = 10
+	}
+	switch watcher.opts.Poll {
+	case "":
+		watcher.opts.Poll = "auto"
+	case "auto", "always", "never":
+	default:
+		return nil, fmt.Errorf("fswatch: unknown poll mode: %s", opts.Poll)
+	}
+	for _, p := range opts.Include {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		watcher.include = append(watcher.include, re)
+	}
+	for _, p := range opts.Exclude {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		watcher.exclude = append(watcher.exclude, re)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	watcher.w = w
+	go watcher.loop()
+	return watcher, nil
+}
+
+// Excluded reports whether a file or directory is skipped by the exclude filters
+func (watcher *Watcher) Excluded(path string) bool {
+	for _, re := range watcher.exclude {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Included reports whether a file passes the include and exclude filters
+func (watcher *Watcher) Included(path string) bool {
+	if watcher.Excluded(path) {
+		return false
+	}
+	if len(watcher.include) == 0 {
+		return true
+	}
+	for _, re := range watcher.include {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTree watches root and every directory below it, or polls it if root is
+// on a filesystem without inotify support
+func (watcher *Watcher) AddTree(root string) error {
+	root = filepath.Clean(root)
+	if watcher.shouldPoll(root) {
+		watcher.startPoller(root)
+		log.Printf("Polling %s every %ds\n", root, watcher.opts.PollSeconds)
+		return nil
+	}
+	watcher.mu.Lock()
+	watcher.roots[root] = true
+	watcher.mu.Unlock()
+	return watcher.walk(root, time.Time{}, false)
+}
+
+func (watcher *Watcher) shouldPoll(root string) bool {
+	switch watcher.opts.Poll {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return isNetworkFS(root)
+}
+
+// walk adds the watches of the directories under root. With emit set the
+// files changed after since are reported as well.
+func (watcher *Watcher) walk(root string, since time.Time, emit bool) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			// A file removed during the walk, e.g. moved by a command, or an
+			// unreadable directory mustn't leave the rest of the tree unwatched
+			if fi != nil && fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.IsDir() {
+			if emit && fi.ModTime().After(since) && watcher.Included(path) {
+				watcher.send(Event{Event: fsnotify.Event{Name: path, Op: fsnotify.Create | fsnotify.CloseWrite}, Scanned: true})
+			}
+			return nil
+		}
+		if path != root && watcher.Excluded(path) {
+			return filepath.SkipDir
+		}
+		// since fsnotify can watch all the files in a directory, watchers only need
+		// to be added to each nested directory
+		if err := watcher.w.Add(path); err != nil {
+			if path != root && errors.Is(err, os.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return watchError(path, err)
+		}
+		watcher.mu.Lock()
+		watcher.dirs[path] = true
+		watcher.mu.Unlock()
+		return nil
+	})
+}
+
+// watchError explains how to fix hitting the watch limit
+func watchError(path string, err error) error {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	limit, _ := os.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	return fmt.Errorf("%w while watching %s, fs.inotify.max_user_watches is %s, raise it with sysctl",
+		ErrWatchLimit, path, strings.TrimSpace(string(limit)))
+}
+
+// RemoveTree stops watching root and every directory below it
+func (watcher *Watcher) RemoveTree(root string) {
+	root = filepath.Clean(root)
+	prefix := root + string(os.PathSeparator)
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	delete(watcher.roots, root)
+	if stop, ok := watcher.pollers[root]; ok {
+		close(stop)
+		delete(watcher.pollers, root)
+	}
+	for dir := range watcher.dirs {
+		if dir == root || strings.HasPrefix(dir, prefix) {
+			// The kernel drops the watch of a deleted directory by itself, so
+			// the error of removing it again doesn't matter
+			watcher.w.Remove(dir)
+			delete(watcher.dirs, dir)
+		}
+	}
+}
+
+func (watcher *Watcher) isDir(path string) bool {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	return watcher.dirs[path]
+}
+
+// rescan walks all the inotify trees again after events were lost, adding
+// missing watches and reporting the files changed since the last event
+func (watcher *Watcher) rescan() {
+	since := watcher.lastEvent.Add(-rescanMargin)
+	watcher.mu.Lock()
+	var roots []string
+	for root := range watcher.roots {
+		roots = append(roots, root)
+	}
+	watcher.mu.Unlock()
+
+	for _, root := range roots {
+		log.Printf("Rescanning %s for files changed since %s\n", root, since.Format(time.RFC3339))
+		if err := watcher.walk(root, since, true); err != nil {
+			watcher.sendError(err)
+		}
+	}
+}
+
+// Run calls handle with every event until the watcher is closed, errors are logged
+func (watcher *Watcher) Run(handle func(Event)) {
+	for {
+		select {
+		case event := <-watcher.Events:
+			handle(event)
+		case err := <-watcher.Errors:
+			log.Println("ERROR", err)
+		case <-watcher.done:
+			return
+		}
+	}
+}
+
+func (watcher *Watcher) Close() error {
+	close(watcher.done)
+	return watcher.w.Close()
+}
+
+func (watcher *Watcher) loop() {
+	for {
+		select {
+		case event, ok := <-watcher.w.Events:
+			if !ok {
+				return
+			}
+			watcher.lastEvent = time.Now()
+			watcher.handle(event)
+		case err, ok := <-watcher.w.Errors:
+			if !ok {
+				return
+			}
+			watcher.sendError(err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				watcher.rescan()
+			}
+		case <-watcher.done:
+			return
+		}
+	}
+}
+
+func (watcher *Watcher) handle(event fsnotify.Event) {
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+			if watcher.Excluded(event.Name) {
+				return
+			}
+			// Files may have been written before the watch was added
+			if err := watcher.walk(event.Name, time.Time{}, true); err != nil {
+				watcher.sendError(err)
+			} else {
+				log.Printf("Watching %s\n", event.Name)
+			}
+			return
+		}
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		if watcher.isDir(event.Name) {
+			watcher.RemoveTree(event.Name)
+		}
+	}
+	if watcher.Included(event.Name) {
+		watcher.send(Event{Event: event})
+	}
+}
+
+func (watcher *Watcher) send(event Event) {
+	select {
+	case watcher.Events <- event:
+	case <-watcher.done:
+	}
+}
+
+func (watcher *Watcher) sendError(err error) {
+	select {
+	case watcher.Errors <- err:
+	case <-watcher.done:
+	}
+}
@@ -0,0 +1,236 @@
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func newTestWatcher(t *testing.T, opts Options) *Watcher {
+	t.Helper()
+	w, err := NewWatcher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	w := newTestWatcher(t, Options{Include: []string{`\.csv$`, `\.gz$`}, Exclude: []string{`/tmp(/|$)`, `^\.|/\.`}})
+	tests := []struct {
+		path               string
+		excluded, included bool
+	}{
+		{"/in/a.csv", false, true},
+		{"/in/a.csv.gz", false, true},
+		{"/in/a.txt", false, false},
+		{"/in/tmp", true, false},
+		{"/in/tmp/a.csv", true, false},
+		{"/in/tmpdir/a.csv", false, true},
+		{"/in/.a.csv", true, false},
+	}
+	for _, tt := range tests {
+		if got := w.Excluded(tt.path); got != tt.excluded {
+			t.Errorf("Excluded(%s) = %t", tt.path, got)
+		}
+		if got := w.Included(tt.path); got != tt.included {
+			t.Errorf("Included(%s) = %t", tt.path, got)
+		}
+	}
+
+	// Without include filters everything not excluded is included
+	w = newTestWatcher(t, Options{Exclude: []string{`\.tmp$`}})
+	if !w.Included("/in/a.txt") || w.Included("/in/a.tmp") {
+		t.Error("only excluded files are skipped without include filters")
+	}
+
+	if _, err := NewWatcher(Options{Include: []string{"("}}); err == nil {
+		t.Error("invalid include accepted")
+	}
+	if _, err := NewWatcher(Options{Poll: "sometimes"}); err == nil {
+		t.Error("unknown poll mode accepted")
+	}
+}
+
+// next returns the next event, or fails after a while
+func next(t *testing.T, w *Watcher) Event {
+	t.Helper()
+	select {
+	case e := <-w.Events:
+		return e
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestWatch(t *testing.T) {
+	root := t.TempDir()
+	w := newTestWatcher(t, Options{Include: []string{`\.csv$`}, Exclude: []string{`/skip$`}, Poll: "never"})
+	if err := w.AddTree(root); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, filepath.Join(root, "a.txt"), "x")
+	writeFile(t, filepath.Join(root, "skip", "a.csv"), "x")
+	writeFile(t, filepath.Join(root, "a.csv"), "x")
+	// The files of a new directory are reported as scanned
+	sub := filepath.Join(t.TempDir(), "sub")
+	writeFile(t, filepath.Join(sub, "b.csv"), "x")
+	if err := os.Rename(sub, filepath.Join(root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the events of the included files come through, the excluded
+	// directory isn't watched
+	for {
+		e := next(t, w)
+		if e.Name == filepath.Join(root, "sub", "b.csv") {
+			if !e.Scanned || e.Op != fsnotify.Create|fsnotify.CloseWrite {
+				t.Errorf("event %v of a new directory", e)
+			}
+			break
+		}
+		if e.Name != filepath.Join(root, "a.csv") || e.Scanned {
+			t.Fatalf("event %v", e)
+		}
+	}
+}
+
+// pollEvents runs a poll, collecting the events it sends
+func pollEvents(w *Watcher, root string, prev map[string]*fileState) (map[string]*fileState, map[string]fsnotify.Op) {
+	events := make(map[string]fsnotify.Op)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range w.Events {
+			events[filepath.Base(e.Name)] = e.Op
+		}
+	}()
+	files := w.pollOnce(root, prev)
+	close(w.Events)
+	<-done
+	w.Events = make(chan Event)
+	return files, events
+}
+
+func TestPoll(t *testing.T) {
+	root := t.TempDir()
+	w := newTestWatcher(t, Options{Include: []string{`\.csv$`}, Exclude: []string{`/skip$`}, Poll: "always"})
+	writeFile(t, filepath.Join(root, "old.csv"), "x")
+	writeFile(t, filepath.Join(root, "gone.csv"), "x")
+
+	// Files existing at the first poll aren't reported
+	files, events := pollEvents(w, root, nil)
+	if len(events) > 0 {
+		t.Errorf("first poll reported %v", events)
+	}
+
+	os.Remove(filepath.Join(root, "gone.csv"))
+	writeFile(t, filepath.Join(root, "new.csv"), "x")
+	writeFile(t, filepath.Join(root, "new.txt"), "x")
+	writeFile(t, filepath.Join(root, "skip", "new.csv"), "x")
+	writeFile(t, filepath.Join(root, "old.csv"), "xx")
+	files, events = pollEvents(w, root, files)
+	if len(events) != 1 || events["gone.csv"] != fsnotify.Remove {
+		t.Errorf("second poll reported %v, want only gone.csv removed", events)
+	}
+
+	// Reported once the size and mtime are the same in two polls in a row
+	writeFile(t, filepath.Join(root, "new.csv"), "xxx")
+	files, events = pollEvents(w, root, files)
+	want := map[string]fsnotify.Op{"old.csv": fsnotify.Write | fsnotify.CloseWrite}
+	if len(events) != 1 || events["old.csv"] != want["old.csv"] {
+		t.Errorf("third poll reported %v, want %v", events, want)
+	}
+	files, events = pollEvents(w, root, files)
+	if len(events) != 1 || events["new.csv"] != fsnotify.Create|fsnotify.CloseWrite {
+		t.Errorf("fourth poll reported %v, want new.csv created", events)
+	}
+	if _, events = pollEvents(w, root, files); len(events) > 0 {
+		t.Errorf("files reported again: %v", events)
+	}
+}
+
+func TestPollAlways(t *testing.T) {
+	root := t.TempDir()
+	w := newTestWatcher(t, Options{Poll: "always", PollSeconds: 1})
+	if err := w.AddTree(root); err != nil {
+		t.Fatal(err)
+	}
+	if w.isDir(root) {
+		t.Error("polled tree is watched with inotify")
+	}
+	// Created after the first poll, when the files already there are listed
+	time.Sleep(100 * time.Millisecond)
+	writeFile(t, filepath.Join(root, "a.csv"), "x")
+	if e := next(t, w); e.Name != filepath.Join(root, "a.csv") || !e.Scanned {
+		t.Errorf("event %v", e)
+	}
+	w.RemoveTree(root)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pollers) > 0 {
+		t.Error("poller isn't stopped")
+	}
+}
+
+// A directory removed while a new tree is walked doesn't stop the walk
+func TestWalkVanished(t *testing.T) {
+	root := t.TempDir()
+	w := newTestWatcher(t, Options{Poll: "never"})
+	if err := w.AddTree(root); err != nil {
+		t.Fatal(err)
+	}
+
+	tree := filepath.Join(t.TempDir(), "new")
+	for _, name := range []string{"a/1.csv", "b/2.csv", "c/3.csv"} {
+		writeFile(t, filepath.Join(tree, name), "x")
+	}
+	dir := filepath.Join(root, "new")
+	if err := os.Rename(tree, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The walk is held by the event of the first file until it's received,
+	// the directories after it are listed already
+	time.Sleep(200 * time.Millisecond)
+	if err := os.RemoveAll(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(t, w); e.Name != filepath.Join(dir, "a", "1.csv") {
+		t.Fatalf("event %v, want a/1.csv first", e)
+	}
+	for {
+		e := next(t, w)
+		if e.Name == filepath.Join(dir, "c", "3.csv") {
+			break
+		}
+		if e.Scanned {
+			t.Fatalf("event %v, want c/3.csv", e)
+		}
+	}
+	if !w.isDir(filepath.Join(dir, "c")) {
+		t.Error("directory after the removed one isn't watched")
+	}
+
+	if err := w.AddTree(filepath.Join(root, "none")); err == nil {
+		t.Error("missing root accepted")
+	}
+}
@@ -0,0 +1,96 @@
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type fileState struct {
+	size     int64
+	mtime    time.Time
+	reported bool
+	existed  bool
+}
+
+func (watcher *Watcher) startPoller(root string) {
+	stop := make(chan struct{})
+	watcher.mu.Lock()
+	if old, ok := watcher.pollers[root]; ok {
+		close(old)
+	}
+	watcher.pollers[root] = stop
+	watcher.mu.Unlock()
+	go watcher.poll(root, stop)
+}
+
+// poll walks root periodically. A new or changed file is reported once its
+// size and mtime are the same in two polls in a row, a file which is gone is
+// reported as removed. Files existing at the first poll aren't reported, the
+// same as with inotify.
+func (watcher *Watcher) poll(root string, stop chan struct{}) {
+	files := watcher.pollOnce(root, nil)
+	ticker := time.NewTicker(time.Duration(watcher.opts.PollSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			files = watcher.pollOnce(root, files)
+		case <-stop:
+			return
+		case <-watcher.done:
+			return
+		}
+	}
+}
+
+func (watcher *Watcher) pollOnce(root string, prev map[string]*fileState) map[string]*fileState {
+	files := make(map[string]*fileState)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// The file may be removed during the walk
+			return nil
+		}
+		if fi.IsDir() {
+			if path != root && watcher.Excluded(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !watcher.Included(path) {
+			return nil
+		}
+
+		st, ok := prev[path]
+		switch {
+		case prev == nil:
+			st = &fileState{size: fi.Size(), mtime: fi.ModTime(), reported: true, existed: true}
+		case !ok:
+			st = &fileState{size: fi.Size(), mtime: fi.ModTime()}
+		case st.size != fi.Size() || !st.mtime.Equal(fi.ModTime()):
+			st.existed = st.existed || st.reported
+			st.size, st.mtime, st.reported = fi.Size(), fi.ModTime(), false
+		case !st.reported:
+			op := fsnotify.Create | fsnotify.CloseWrite
+			if st.existed {
+				op = fsnotify.Write | fsnotify.CloseWrite
+			}
+			watcher.send(Event{Event: fsnotify.Event{Name: path, Op: op}, Scanned: true})
+			st.reported = true
+		}
+		files[path] = st
+		return nil
+	})
+	if err != nil {
+		watcher.sendError(err)
+	}
+
+	for path := range prev {
+		if _, ok := files[path]; !ok {
+			watcher.send(Event{Event: fsnotify.Event{Name: path, Op: fsnotify.Remove}, Scanned: true})
+		}
+	}
+	return files
+}
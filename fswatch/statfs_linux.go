@@ -0,0 +1,22 @@
+package fswatch
+
+import "syscall"
+
+// Magic numbers of the filesystems which don't report remote changes to inotify, see statfs(2)
+var networkFS = map[int64]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+}
+
+// isNetworkFS reports whether path is on a filesystem which has to be polled
+func isNetworkFS(path string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false
+	}
+	_, ok := networkFS[int64(st.Type)]
+	return ok
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package fswatch
+
+// isNetworkFS reports whether path is on a filesystem which has to be polled,
+// it's only detected on Linux
+func isNetworkFS(path string) bool {
+	return false
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wadewyuan/go-tools/fswatch"
+	"github.com/wadewyuan/go-tools/stability"
+)
+
+// Events is a list of event names, e.g. ["CLOSEWRITE", "CREATE"].
+// A single string is also accepted so older config files keep working.
+type Events []string
+
+func (e *Events) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if len(s) > 0 {
+			*e = Events{s}
+		}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return fmt.Errorf("localevent must be a string or a list of strings: %w", err)
+	}
+	*e = l
+	return nil
+}
+
+var eventOps = map[string]fsnotify.Op{
+	"CLOSEWRITE": fsnotify.CloseWrite,
+	"CREATE":     fsnotify.Create,
+	"REMOVE":     fsnotify.Remove,
+	"WRITE":      fsnotify.Write,
+	"CHMOD":      fsnotify.Chmod,
+	"RENAME":     fsnotify.Rename,
+}
+
+// mask combines the events into a single op mask, defaulting to Create
+func (e Events) mask() (fsnotify.Op, error) {
+	if len(e) == 0 {
+		return fsnotify.Create, nil
+	}
+	var op fsnotify.Op
+	for _, name := range e {
+		o, ok := eventOps[strings.ToUpper(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown event: %s", name)
+		}
+		op |= o
+	}
+	return op, nil
+}
+
+// Duration is a time.Duration read from a string like "30s" or "5m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rule describes which events to react on and what to do with the file
+type Rule struct {
+	Name string
+
+	LocalEvent Events
+
+	LocalPaths []string
+
+	Pattern string
+
+	// Action is what to do with a matched file, "command" or "route"
+	Action string
+
+	// Where to put the file for the "route" action
+	Route Route
+
+	// PostCommand is run by bash, placeholder values are shell quoted.
+	// It's optional for the "route" action, and runs in the routed directory.
+	PostCommand string
+
+	// PostArgs is executed directly without a shell, it takes precedence over PostCommand
+	PostArgs []string
+
+	AlarmCode string
+
+	// Max number of commands of this rule running at the same time, default 4
+	Concurrency int
+
+	// Commands running longer than this are killed, no limit by default
+	Timeout Duration
+
+	// File to save the output of the commands to, the standard log is used when empty
+	LogFile string
+
+	// Size in MB at which LogFile is rotated, default 10
+	LogMaxSize int64
+
+	// Number of rotated log files to keep, default 5
+	LogBackups int
+
+	// Checks to make sure a file is completely written before processing it
+	Stability stability.Options
+
+	// Coalesce the events of a file until there are none for this long, then
+	// trigger once. Events are handled as they come when not set.
+	Debounce Duration
+
+	ops      fsnotify.Op
+	re       *regexp.Regexp
+	jobs     chan fswatch.Event
+	output   *rotatingFile
+	stable   *stability.Checker
+	debounce *debouncer
+	ledger   *ledger
+	waiting  sync.WaitGroup
+	workers  sync.WaitGroup
+	mu       sync.Mutex
+	retiring bool
+}
+
+type Config struct {
+	// The single rule settings below are kept for older config files,
+	// they are only used when no rules are configured
+	LocalEvent Events
+
+	LocalPaths []string
+
+	Pattern string
+
+	PostCommand string
+
+	// Default alarm code for rules without one
+	AlarmCode string
+
+	// Filters and polling of the file watcher
+	Watch fswatch.Options
+
+	// File to record the processed files in, with their fingerprints (inode,
+	// size and mtime), so the same file isn't processed twice even across
+	// restarts, and the files which arrived while the process was down are
+	// caught up on at startup
+	LedgerFile string
+
+	// Days to keep the ledger entries for, default 30
+	LedgerDays int
+
+	Rules []*Rule
+
+	ledger *ledger
+}
+
+// loadConfig reads and checks the config file. When reloading, the running
+// config is passed as old so state shared with it is kept. The ledger is only
+// compacted with compact set, which is for the watcher itself and not the
+// command line queries.
+func loadConfig(path string, old *Config, compact bool) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open config file: %w", err)
+	}
+	defer file.Close()
+
+	var conf Config
+	if err := json.NewDecoder(file).Decode(&conf); err != nil {
+		return nil, fmt.Errorf("can't decode config JSON: %w", err)
+	}
+	if err := conf.init(old, compact); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// init fills in the defaults and compiles every rule
+func (conf *Config) init(old *Config, compact bool) error {
+	if len(conf.Rules) == 0 {
+		conf.Rules = []*Rule{{
+			LocalEvent:  conf.LocalEvent,
+			LocalPaths:  conf.LocalPaths,
+			Pattern:     conf.Pattern,
+			PostCommand: conf.PostCommand,
+		}}
+	}
+
+	if conf.LedgerDays <= 0 {
+		conf.LedgerDays = 30
+	}
+	if len(conf.LedgerFile) > 0 {
+		if old != nil && old.LedgerFile == conf.LedgerFile {
+			// The file is still appended to by the old rules
+			conf.ledger = old.ledger
+		} else {
+			var err error
+			retention := time.Duration(conf.LedgerDays) * 24 * time.Hour
+			if conf.ledger, err = openLedger(conf.LedgerFile, retention, compact); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, r := range conf.Rules {
+		if len(r.Name) == 0 {
+			r.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		if len(r.AlarmCode) == 0 {
+			r.AlarmCode = conf.AlarmCode
+		}
+		if len(r.Action) == 0 {
+			r.Action = "command"
+		}
+		if r.Concurrency <= 0 {
+			r.Concurrency = 4
+		}
+		if r.LogMaxSize <= 0 {
+			r.LogMaxSize = 10
+		}
+		if r.LogBackups <= 0 {
+			r.LogBackups = 5
+		}
+		r.ledger = conf.ledger
+		if err := r.init(); err != nil {
+			if conf.ledger != nil && (old == nil || conf.ledger != old.ledger) {
+				conf.ledger.close()
+			}
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) init() error {
+	if len(r.LocalPaths) == 0 {
+		return errors.New("localpaths is required")
+	}
+	for i, p := range r.LocalPaths {
+		r.LocalPaths[i] = filepath.Clean(p)
+	}
+
+	var err error
+	if r.ops, err = r.LocalEvent.mask(); err != nil {
+		return err
+	}
+	if r.re, err = regexp.Compile(r.Pattern); err != nil {
+		return err
+	}
+	r.stable = stability.NewChecker(r.Stability)
+	if r.Debounce > 0 {
+		r.debounce = newDebouncer(time.Duration(r.Debounce), r.fire)
+	}
+
+	var extraVars []string
+	switch r.Action {
+	case "command":
+		if len(r.PostCommand) == 0 && len(r.PostArgs) == 0 {
+			return errors.New("postcommand or postargs is required")
+		}
+	case "route":
+		if err := r.Route.init(r); err != nil {
+			return err
+		}
+		extraVars = routeVarNames
+	default:
+		return fmt.Errorf("unknown action: %s", r.Action)
+	}
+	for _, tmpl := range append([]string{r.PostCommand}, r.PostArgs...) {
+		if err := checkTemplate(tmpl, r.re, extraVars); err != nil {
+			return err
+		}
+	}
+	if len(r.LogFile) > 0 {
+		if r.output, err = newRotatingFile(r.LogFile, r.LogMaxSize<<20, r.LogBackups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether the event should be handled by this rule
+func (r *Rule) matches(event fswatch.Event) bool {
+	if event.Op&r.ops == 0 {
+		return false
+	}
+	return r.accepts(event.Name)
+}
+
+// accepts reports whether the file is watched by this rule, whatever the event
+func (r *Rule) accepts(path string) bool {
+	return r.covers(path) && r.re.MatchString(path)
+}
+
+// covers reports whether path is one of, or under one of, the rule's paths
+func (r *Rule) covers(path string) bool {
+	for _, p := range r.LocalPaths {
+		if path == p || strings.HasPrefix(path, p+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// paths returns the paths of all rules without duplicates
+func (conf *Config) paths() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, r := range conf.Rules {
+		for _, p := range r.LocalPaths {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
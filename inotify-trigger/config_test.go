@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wadewyuan/go-tools/fswatch"
+)
+
+func TestEvents(t *testing.T) {
+	tests := []struct {
+		json string
+		want Events
+	}{
+		{`"CLOSEWRITE"`, Events{"CLOSEWRITE"}},
+		{`""`, nil},
+		{`["CREATE", "closewrite"]`, Events{"CREATE", "closewrite"}},
+		{`[]`, Events{}},
+	}
+	for _, tt := range tests {
+		var e Events
+		if err := json.Unmarshal([]byte(tt.json), &e); err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		if !reflect.DeepEqual(e, tt.want) {
+			t.Errorf("%s is %#v, want %#v", tt.json, e, tt.want)
+		}
+	}
+	var e Events
+	if err := json.Unmarshal([]byte(`{"op": "CREATE"}`), &e); err == nil {
+		t.Error("an object is accepted")
+	}
+}
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		events Events
+		want   fsnotify.Op
+	}{
+		{nil, fsnotify.Create},
+		{Events{"CREATE"}, fsnotify.Create},
+		{Events{"closewrite", "Rename", "REMOVE"}, fsnotify.CloseWrite | fsnotify.Rename | fsnotify.Remove},
+		{Events{"WRITE", "CHMOD", "WRITE"}, fsnotify.Write | fsnotify.Chmod},
+	}
+	for _, tt := range tests {
+		if got, err := tt.events.mask(); err != nil || got != tt.want {
+			t.Errorf("%v: %v, %v, want %v", tt.events, got, err, tt.want)
+		}
+	}
+	if _, err := (Events{"CREATE", "MODIFY"}).mask(); err == nil || err.Error() != "unknown event: MODIFY" {
+		t.Errorf("unknown event: %v", err)
+	}
+
+	conf := &Config{Rules: []*Rule{{LocalPaths: []string{"/in"}, LocalEvent: Events{"DELETE"}, PostCommand: "true"}}}
+	if err := conf.init(nil, true); err == nil {
+		t.Error("rule with an unknown event accepted")
+	}
+}
+
+// The settings of a single rule at the top level are kept for older config files
+func TestLegacyConfig(t *testing.T) {
+	var conf Config
+	b := []byte(`{"localevent": "CLOSEWRITE", "localpaths": ["/in/"], "pattern": "\\.csv$", "postcommand": "load ${FILE}"}`)
+	if err := json.Unmarshal(b, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.init(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Rules) != 1 {
+		t.Fatalf("%d rules", len(conf.Rules))
+	}
+	r := conf.Rules[0]
+	if r.Name != "rule1" || r.ops != fsnotify.CloseWrite || r.LocalPaths[0] != "/in" || r.PostCommand != "load ${FILE}" {
+		t.Errorf("rule %+v", r)
+	}
+}
+
+// queued returns the names of the files queued for the rule so far
+func queued(r *Rule) []string {
+	var names []string
+	for {
+		select {
+		case event := <-r.jobs:
+			names = append(names, event.Name)
+		default:
+			sort.Strings(names)
+			return names
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	conf := &Config{Rules: []*Rule{
+		{Name: "csv", LocalPaths: []string{"/in/a"}, Pattern: `\.csv$`, PostCommand: "true"},
+		{Name: "all", LocalPaths: []string{"/in"}, LocalEvent: Events{"CLOSEWRITE", "REMOVE"}, PostCommand: "true"},
+		{Name: "debounced", LocalPaths: []string{"/in/b"}, Debounce: Duration(time.Hour), PostCommand: "true"},
+	}}
+	if err := conf.init(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range conf.Rules {
+		r.jobs = make(chan fswatch.Event, 10)
+	}
+
+	events := []struct {
+		name string
+		op   fsnotify.Op
+	}{
+		{"/in/a/1.csv", fsnotify.Create},
+		{"/in/a/1.csv", fsnotify.Write},
+		{"/in/a/1.csv", fsnotify.CloseWrite},
+		{"/in/a/2.txt", fsnotify.Create | fsnotify.CloseWrite},
+		{"/in/b/3.csv", fsnotify.Create},
+		{"/in/b/3.csv", fsnotify.Remove},
+		{"/other/4.csv", fsnotify.Create | fsnotify.CloseWrite},
+	}
+	for _, e := range events {
+		dispatch(fswatch.Event{Event: fsnotify.Event{Name: e.name, Op: e.op}}, conf)
+	}
+
+	want := map[string][]string{
+		"csv":       {"/in/a/1.csv"},
+		"all":       {"/in/a/1.csv", "/in/a/2.txt", "/in/b/3.csv"},
+		"debounced": nil,
+	}
+	for _, r := range conf.Rules {
+		if got := queued(r); !reflect.DeepEqual(got, want[r.Name]) {
+			t.Errorf("%s queued %v, want %v", r.Name, got, want[r.Name])
+		}
+	}
+	// The events of the debounced rule wait for the file to be quiet, whatever their op
+	d := conf.Rules[2].debounce
+	d.mu.Lock()
+	p, n := d.pending["/in/b/3.csv"], len(d.pending)
+	d.mu.Unlock()
+	if p == nil || p.op != fsnotify.Create|fsnotify.Remove || n != 1 {
+		t.Errorf("%d debounced files, %v", n, p)
+	}
+	d.stop()
+}
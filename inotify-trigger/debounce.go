@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wadewyuan/go-tools/fswatch"
+)
+
+// debouncer coalesces the events of a path until there are none for the quiet
+// window, then fires a single event with all the ops seen
+type debouncer struct {
+	mu      sync.Mutex
+	window  time.Duration
+	pending map[string]*pendingEvent
+	fire    func(fswatch.Event)
+	firing  sync.WaitGroup
+	stopped bool
+
+	// time.AfterFunc, replaced by the tests
+	afterFunc func(time.Duration, func()) debounceTimer
+}
+
+// debounceTimer is the part of time.Timer the debouncer uses
+type debounceTimer interface {
+	Reset(time.Duration) bool
+	Stop() bool
+}
+
+type pendingEvent struct {
+	op      fsnotify.Op
+	scanned bool
+	timer   debounceTimer
+}
+
+func newDebouncer(window time.Duration, fire func(fswatch.Event)) *debouncer {
+	return &debouncer{
+		window:  window,
+		pending: make(map[string]*pendingEvent),
+		fire:    fire,
+		afterFunc: func(d time.Duration, f func()) debounceTimer {
+			return time.AfterFunc(d, f)
+		},
+	}
+}
+
+func (d *debouncer) add(event fswatch.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+
+	p, ok := d.pending[event.Name]
+	if ok {
+		p.timer.Reset(d.window)
+	} else {
+		name := event.Name
+		p = &pendingEvent{scanned: true}
+		p.timer = d.afterFunc(d.window, func() {
+			d.flush(name)
+		})
+		d.pending[name] = p
+	}
+	p.op |= event.Op
+	p.scanned = p.scanned && event.Scanned
+}
+
+func (d *debouncer) flush(name string) {
+	d.mu.Lock()
+	p, ok := d.pending[name]
+	delete(d.pending, name)
+	if ok {
+		d.firing.Add(1)
+	}
+	d.mu.Unlock()
+
+	if ok {
+		defer d.firing.Done()
+		d.fire(fswatch.Event{Event: fsnotify.Event{Name: name, Op: p.op}, Scanned: p.scanned})
+	}
+}
+
+// stop fires all the pending events at once and waits until they're handled,
+// later events are ignored
+func (d *debouncer) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	var names []string
+	for name, p := range d.pending {
+		p.timer.Stop()
+		names = append(names, name)
+	}
+	d.mu.Unlock()
+
+	for _, name := range names {
+		d.flush(name)
+	}
+	d.firing.Wait()
+}
+
+// fire handles the coalesced event of a path once it has been quiet
+func (r *Rule) fire(event fswatch.Event) {
+	if event.Op&r.ops == 0 {
+		return
+	}
+	if r.ops&(fsnotify.Remove|fsnotify.Rename) == 0 {
+		// The file may have been a temporary one, e.g. renamed away by an editor or rsync
+		if _, err := os.Stat(event.Name); os.IsNotExist(err) {
+			log.Printf("[%s] Skipping %s, file is gone", r.Name, event.Name)
+			return
+		}
+	}
+	r.enqueue(event)
+}
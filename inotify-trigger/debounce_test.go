@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wadewyuan/go-tools/fswatch"
+)
+
+// firedEvents collects the events fired by a debouncer
+type firedEvents struct {
+	mu     sync.Mutex
+	events []fswatch.Event
+}
+
+func (f *firedEvents) fire(event fswatch.Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+}
+
+func (f *firedEvents) get() []fswatch.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fswatch.Event{}, f.events...)
+}
+
+func event(name string, op fsnotify.Op, scanned bool) fswatch.Event {
+	return fswatch.Event{Event: fsnotify.Event{Name: name, Op: op}, Scanned: scanned}
+}
+
+// fakeClock runs the timers of a debouncer as the test moves it forward
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Duration
+	fn     func()
+	active bool
+}
+
+func (c *fakeClock) afterFunc(d time.Duration, fn func()) debounceTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now + d, fn: fn, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.at, t.active = t.clock.now+d, true
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+// advance moves the clock forward and runs the timers due by then
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now += d
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if t.active && t.at <= c.now {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range due {
+		t.fn()
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	var fired firedEvents
+	var clock fakeClock
+	d := newDebouncer(100*time.Millisecond, fired.fire)
+	d.afterFunc = clock.afterFunc
+	d.add(event("/a", fsnotify.Create, false))
+	d.add(event("/b", fsnotify.Create|fsnotify.CloseWrite, true))
+	for i := 0; i < 4; i++ {
+		clock.advance(50 * time.Millisecond)
+		d.add(event("/a", fsnotify.Write, false))
+	}
+	d.add(event("/a", fsnotify.CloseWrite, true))
+
+	// /b has been quiet for long enough, /a is still being written
+	if got := fired.get(); len(got) != 1 || got[0] != event("/b", fsnotify.Create|fsnotify.CloseWrite, true) {
+		t.Fatalf("fired %v, want /b only", got)
+	}
+	clock.advance(99 * time.Millisecond)
+	if got := fired.get(); len(got) != 1 {
+		t.Fatalf("fired %v before /a was quiet for the window", got)
+	}
+	clock.advance(time.Millisecond)
+	got := fired.get()
+	if len(got) != 2 {
+		t.Fatalf("fired %v, want /b then /a", got)
+	}
+	// Scanned only when all the events were
+	if want := event("/a", fsnotify.Create|fsnotify.Write|fsnotify.CloseWrite, false); got[1] != want {
+		t.Errorf("fired %v, want %v", got[1], want)
+	}
+	clock.advance(time.Hour)
+	if got := fired.get(); len(got) != 2 {
+		t.Errorf("fired %v, want each path once", got)
+	}
+}
+
+func TestDebounceStop(t *testing.T) {
+	var fired firedEvents
+	d := newDebouncer(time.Hour, func(event fswatch.Event) {
+		time.Sleep(50 * time.Millisecond)
+		fired.fire(event)
+	})
+	d.add(event("/a", fsnotify.Create, false))
+	d.add(event("/b", fsnotify.Create, false))
+
+	// The pending events are fired at once, and handled when stop returns
+	d.stop()
+	if got := fired.get(); len(got) != 2 {
+		t.Fatalf("fired %v after stop, want /a and /b", got)
+	}
+	d.add(event("/c", fsnotify.Create, false))
+	d.stop()
+	if got := fired.get(); len(got) != 2 {
+		t.Errorf("fired %v, events after stop aren't ignored", got)
+	}
+}
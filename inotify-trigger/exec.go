@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wadewyuan/go-tools/fswatch"
+	alarm "github.com/wadewyuan/smartom-utils-go"
+)
+
+// Size of the queue in front of each rule's workers, events block when it's full
+const queueSize = 10000
+
+// start creates the job queue of the rule and its workers
+func (r *Rule) start() {
+	r.jobs = make(chan fswatch.Event, queueSize)
+	r.workers.Add(r.Concurrency)
+	for i := 0; i < r.Concurrency; i++ {
+		go r.worker()
+	}
+}
+
+// retire stops the rule after a config reload. The events already received
+// are still processed: the debounced ones are fired at once and the ones
+// waiting for the file to be complete are waited for, then the workers exit
+// after draining the queue.
+func (r *Rule) retire() {
+	r.mu.Lock()
+	r.retiring = true
+	r.mu.Unlock()
+	if r.debounce != nil {
+		r.debounce.stop()
+	}
+	r.waiting.Wait()
+	close(r.jobs)
+	r.workers.Wait()
+	if r.output != nil {
+		r.output.Close()
+	}
+	log.Printf("[%s] Retired", r.Name)
+}
+
+// enqueue queues the event for the workers, after the file is complete when
+// the rule has stability checks
+func (r *Rule) enqueue(event fswatch.Event) {
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		// Nothing to wait for when the file is gone
+		r.jobs <- event
+		return
+	}
+	// Skipped when ignored, or merged into a wait for the same file
+	r.waiting.Add(1)
+	handled := r.stable.Handle(event.Name, func(err error) {
+		defer r.waiting.Done()
+		if err != nil {
+			r.fail(event.Name, err)
+			return
+		}
+		r.jobs <- event
+	})
+	if !handled {
+		r.waiting.Done()
+	}
+}
+
+func (r *Rule) worker() {
+	defer r.workers.Done()
+	for event := range r.jobs {
+		if err := r.process(event, false); err != nil {
+			r.fail(event.Name, err)
+		}
+	}
+}
+
+// catchUp queues the files of the rule which aren't in the ledger, e.g. the
+// ones that arrived while the process was down. Files skipped by the filters
+// of the watcher or older than the ledger's records are left alone.
+func (r *Rule) catchUp() {
+	if r.ledger == nil || r.ops&(fsnotify.Create|fsnotify.Write|fsnotify.CloseWrite) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.retiring {
+		return
+	}
+	r.waiting.Add(1)
+	go func() {
+		defer r.waiting.Done()
+		for _, root := range r.LocalPaths {
+			filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				if fi.IsDir() {
+					if path != root && watcher.Excluded(path) {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if !r.accepts(path) || !watcher.Included(path) || fi.ModTime().Before(r.ledger.since) {
+					return nil
+				}
+				if r.ledger.seen(r.Name, path, fingerprint(fi)) {
+					return nil
+				}
+				log.Printf("[%s] Catching up on %s", r.Name, path)
+				r.enqueue(fswatch.Event{Event: fsnotify.Event{Name: path, Op: fsnotify.Create | fsnotify.CloseWrite}, Scanned: true})
+				return nil
+			})
+		}
+	}()
+}
+
+// fail logs the error and raises the alarm of the rule
+func (r *Rule) fail(path string, err error) {
+	var msg = fmt.Sprintf("Error processing file: %s ", path)
+	log.Println(msg, err)
+	if len(r.AlarmCode) > 0 {
+		alarm.SendAlarm(r.AlarmCode, msg)
+	}
+}
+
+// process handles the file according to the rule's action, unless this
+// version of it was processed already. With force set it's always processed.
+func (r *Rule) process(event fswatch.Event, force bool) error {
+	path := event.Name
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	fp := fingerprint(stat)
+	if !force && r.ledger != nil && r.ledger.seen(r.Name, path, fp) {
+		log.Printf("[%s] Skipping %s, already processed", r.Name, path)
+		return nil
+	}
+	log.Printf("[%s] Processing file: %s, size: %d", r.Name, path, stat.Size())
+
+	start := time.Now()
+	vars := newFileVars(path, event.Op, stat, r.re)
+	if r.Action == "route" {
+		err = r.route(path, vars)
+	} else {
+		err = r.run(path, vars, "")
+	}
+
+	if r.ledger != nil {
+		e := &entry{
+			Rule:        r.Name,
+			Path:        path,
+			Fingerprint: fp,
+			Status:      "ok",
+			Started:     start,
+			Finished:    time.Now(),
+		}
+		if err != nil {
+			e.Status = err.Error()
+			e.ExitCode = -1
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				e.ExitCode = exitErr.ExitCode()
+			}
+		}
+		if err := r.ledger.record(e); err != nil {
+			log.Println("ERROR", err)
+		}
+	}
+	return err
+}
+
+// run runs the rule's command for the file in dir and waits for it to finish,
+// a non-zero exit status or a timeout is returned as an error
+func (r *Rule) run(path string, vars fileVars, dir string) error {
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.Timeout))
+		defer cancel()
+	}
+	cmd := r.command(ctx, vars)
+	cmd.Dir = dir
+	log.Printf("[%s] Command: %s", r.Name, cmd.String())
+
+	// Run the command in its own process group, so the children of a shell
+	// are killed together with it on timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+
+	out := r.outputWriter(path)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	start := time.Now()
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("command timed out after %s", time.Duration(r.Timeout))
+	}
+	out.Close()
+	r.writeStatus(out, path, start, err)
+	return err
+}
+
+// outputWriter returns the writer of a command's output, to the rule's log
+// file or to the standard log when no log file is configured. Its lines are
+// prefixed with the rule and the file.
+func (r *Rule) outputWriter(path string) *lineWriter {
+	l := &lineWriter{prefix: fmt.Sprintf("[%s] %s: ", r.Name, path)}
+	if r.output == nil {
+		l.out = func(line string) {
+			log.Print(line)
+		}
+	} else {
+		l.out = func(line string) {
+			if _, err := r.output.Write([]byte(line)); err != nil {
+				log.Println("ERROR", err)
+			}
+		}
+	}
+	return l
+}
+
+// writeStatus ends the output of a command with its status, the standard log
+// only gets it after some output
+func (r *Rule) writeStatus(out *lineWriter, path string, start time.Time, err error) {
+	if r.output == nil && out.lines == 0 {
+		return
+	}
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	out.out(fmt.Sprintf("[%s] %s, started: %s, elapsed: %s, status: %s\n",
+		r.Name, path, start.Format(time.RFC3339), time.Since(start).Round(time.Millisecond), status))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// fingerprint identifies the content of a file without reading it
+func fingerprint(fi os.FileInfo) string {
+	var ino uint64
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		ino = st.Ino
+	}
+	return fmt.Sprintf("%d:%d:%d", ino, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// entry is the record of a file processed by a rule
+type entry struct {
+	Rule        string    `json:"rule"`
+	Path        string    `json:"path"`
+	Fingerprint string    `json:"fingerprint"`
+	Status      string    `json:"status"`
+	ExitCode    int       `json:"exit_code"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+}
+
+func (e *entry) ok() bool {
+	return e.Status == "ok"
+}
+
+// ledger remembers the files processed by every rule, so the same version of
+// a file isn't processed twice and the ones missed while the process was down
+// can be caught up on. It's kept in an append-only file of JSON lines, which
+// is compacted on startup.
+type ledger struct {
+	mu   sync.Mutex
+	last map[string]*entry // rule\tpath -> latest entry
+	file *os.File
+
+	// Start of the records kept: the oldest entry, or the opening of the
+	// ledger when it has none. Older files can't be told apart from the ones
+	// processed before, so they aren't caught up on.
+	since time.Time
+}
+
+// readLedger calls fn with every entry of the ledger file, oldest first
+func readLedger(name string, fn func(*entry)) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Skip a line cut short by a crash
+			continue
+		}
+		fn(&e)
+	}
+	return scanner.Err()
+}
+
+// openLedger loads the ledger file. With compact set the file is rewritten
+// with the entries finished within retention, keeping only the latest entry
+// of a file per rule; this must only be done by the running watcher.
+func openLedger(name string, retention time.Duration, compact bool) (*ledger, error) {
+	l := &ledger{last: make(map[string]*entry), since: time.Now()}
+	var entries []*entry
+	cutoff := time.Now().Add(-retention)
+	err := readLedger(name, func(e *entry) {
+		if e.Finished.Before(cutoff) {
+			return
+		}
+		entries = append(entries, e)
+		l.last[e.Rule+"\t"+e.Path] = e
+		if e.Started.Before(l.since) {
+			l.since = e.Started
+		}
+	})
+	if l.since.Before(cutoff) {
+		l.since = cutoff
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if compact {
+		tmp := name + ".tmp"
+		f, err := os.Create(tmp)
+		if err != nil {
+			return nil, err
+		}
+		w := bufio.NewWriter(f)
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			if l.last[e.Rule+"\t"+e.Path] == e {
+				enc.Encode(e)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.Close()
+		if err := os.Rename(tmp, name); err != nil {
+			return nil, err
+		}
+	}
+
+	l.file, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// seen reports whether this version of the file was processed by the rule successfully
+func (l *ledger) seen(rule, path, fp string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.last[rule+"\t"+path]
+	return ok && e.ok() && e.Fingerprint == fp
+}
+
+func (l *ledger) record(e *entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last[e.Rule+"\t"+e.Path] = e
+	// A single write of the whole line, so concurrent writers don't interleave
+	_, err = l.file.Write(append(b, '\n'))
+	return err
+}
+
+// close closes the ledger file, once no rule records in it anymore
+func (l *ledger) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// printFailures writes the failed entries finished within the last d as a table
+func printFailures(w io.Writer, name string, d time.Duration) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FINISHED\tRULE\tEXIT\tPATH\tSTATUS")
+	cutoff := time.Now().Add(-d)
+	err := readLedger(name, func(e *entry) {
+		if !e.ok() && e.Finished.After(cutoff) {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", e.Finished.Format("2006-01-02 15:04:05"), e.Rule, e.ExitCode, e.Path, e.Status)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
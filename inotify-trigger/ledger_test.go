@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wadewyuan/go-tools/fswatch"
+)
+
+func writeLedger(t *testing.T, name string, entries ...*entry) {
+	t.Helper()
+	var b strings.Builder
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	if err := os.WriteFile(name, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ledger")
+	now := time.Now()
+	writeLedger(t, name,
+		&entry{Rule: "r", Path: "/a", Fingerprint: "1", Status: "ok", Started: now.Add(-48 * time.Hour), Finished: now.Add(-48 * time.Hour)},
+		&entry{Rule: "r", Path: "/a", Fingerprint: "2", Status: "ok", Started: now.Add(-time.Hour), Finished: now.Add(-time.Hour)},
+		&entry{Rule: "r", Path: "/b", Fingerprint: "1", Status: "exit status 1", Started: now.Add(-time.Hour), Finished: now.Add(-time.Hour)},
+		&entry{Rule: "r", Path: "/old", Fingerprint: "1", Status: "ok", Started: now.Add(-72 * time.Hour), Finished: now.Add(-72 * time.Hour)},
+	)
+
+	l, err := openLedger(name, 60*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rule, path, fp string
+		want           bool
+	}{
+		{"r", "/a", "2", true},
+		{"r", "/a", "1", false}, // changed since
+		{"r", "/b", "1", false}, // failed
+		{"r", "/old", "1", false},
+		{"other", "/a", "2", false},
+	}
+	for _, tt := range tests {
+		if got := l.seen(tt.rule, tt.path, tt.fp); got != tt.want {
+			t.Errorf("seen(%s, %s, %s) = %t, want %t", tt.rule, tt.path, tt.fp, got, tt.want)
+		}
+	}
+	if want := now.Add(-48 * time.Hour); !l.since.Equal(want) {
+		t.Errorf("since = %s, want %s", l.since, want)
+	}
+
+	if err := l.record(&entry{Rule: "r", Path: "/b", Fingerprint: "1", Status: "ok", Started: now, Finished: now}); err != nil {
+		t.Fatal(err)
+	}
+	if !l.seen("r", "/b", "1") {
+		t.Error("recorded entry isn't seen")
+	}
+	l.file.Close()
+
+	// Compacted to the latest entry of each file within the retention
+	var lines []string
+	readLedger(name, func(e *entry) {
+		lines = append(lines, e.Path+" "+e.Fingerprint+" "+e.Status)
+	})
+	want := []string{"/a 2 ok", "/b 1 exit status 1", "/b 1 ok"}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ledger file\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLedgerEmpty(t *testing.T) {
+	start := time.Now()
+	l, err := openLedger(filepath.Join(t.TempDir(), "ledger"), time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.file.Close()
+	if l.since.Before(start) {
+		t.Errorf("since = %s, want the opening of the ledger", l.since)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	files := map[string]time.Duration{ // name -> age
+		"new.txt":         time.Hour,
+		"done.txt":        time.Hour,
+		"old.txt":         72 * time.Hour,
+		"other.dat":       time.Hour,
+		"archive/new.txt": time.Hour,
+		"sub/new.txt":     time.Hour,
+	}
+	for name, age := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+	fi, err := os.Stat(filepath.Join(dir, "done.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledgerFile := filepath.Join(t.TempDir(), "ledger")
+	writeLedger(t, ledgerFile, &entry{Rule: "r", Path: filepath.Join(dir, "done.txt"), Fingerprint: fingerprint(fi), Status: "ok", Started: now.Add(-48 * time.Hour), Finished: now.Add(-48 * time.Hour)})
+
+	conf := &Config{
+		LedgerFile: ledgerFile,
+		Rules:      []*Rule{{Name: "r", LocalEvent: Events{"CLOSEWRITE"}, LocalPaths: []string{dir}, Pattern: `\.txt$`, PostCommand: "true"}},
+	}
+	if err := conf.init(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	defer conf.ledger.file.Close()
+	watcher, err = fswatch.NewWatcher(fswatch.Options{Exclude: []string{"/archive/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	r := conf.Rules[0]
+	r.jobs = make(chan fswatch.Event, 10)
+	r.catchUp()
+	r.waiting.Wait()
+	close(r.jobs)
+	var got []string
+	for event := range r.jobs {
+		rel, _ := filepath.Rel(dir, event.Name)
+		got = append(got, rel)
+	}
+	sort.Strings(got)
+	want := []string{"new.txt", "sub/new.txt"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("caught up on %v, want %v", got, want)
+	}
+
+	// Nothing is queued once the rule is retiring
+	r.retiring = true
+	r.catchUp()
+	r.waiting.Wait()
+}
+
+func TestUnchanged(t *testing.T) {
+	old := []*Rule{
+		{Name: "a", LocalPaths: []string{"/x"}, Pattern: "1", PostCommand: "true", Timeout: Duration(time.Minute)},
+		{Name: "b", LocalPaths: []string{"/y"}, Pattern: "2", PostCommand: "true"},
+	}
+	tests := []struct {
+		rule *Rule
+		want bool
+	}{
+		{&Rule{Name: "a", LocalPaths: []string{"/x"}, Pattern: "1", PostCommand: "true", Timeout: Duration(time.Minute)}, true},
+		{&Rule{Name: "a", LocalPaths: []string{"/x"}, Pattern: "1", PostCommand: "true"}, false},
+		{&Rule{Name: "b", LocalPaths: []string{"/y", "/z"}, Pattern: "2", PostCommand: "true"}, false},
+		{&Rule{Name: "c", LocalPaths: []string{"/y"}, Pattern: "2", PostCommand: "true"}, false},
+	}
+	for i, tt := range tests {
+		if got := unchanged(tt.rule, old); got != tt.want {
+			t.Errorf("%d: unchanged = %t, want %t", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file which is rotated to name.1, name.2, ... once it
+// grows beyond maxSize bytes, keeping at most backups old files
+type rotatingFile struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func newRotatingFile(name string, maxSize int64, backups int) (*rotatingFile, error) {
+	w := &rotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingFile) open() error {
+	f, err := os.OpenFile(w.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	return nil
+}
+
+func (w *rotatingFile) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingFile) rotate() error {
+	w.f.Close()
+	for i := w.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.name, i), fmt.Sprintf("%s.%d", w.name, i+1))
+	}
+	if w.backups > 0 {
+		os.Rename(w.name, w.name+".1")
+	} else {
+		os.Remove(w.name)
+	}
+	return w.open()
+}
+
+func (w *rotatingFile) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// Longest part of a line held back waiting for its end, longer lines are
+// written in pieces
+const maxLine = 64 << 10
+
+// lineWriter streams the output of a command line by line, each line with a
+// prefix telling the commands running at once apart. The last line, when not
+// ended, is written on Close.
+type lineWriter struct {
+	mu     sync.Mutex
+	prefix string
+	out    func(line string)
+	buf    []byte
+	lines  int
+}
+
+// Write never fails, the command mustn't fail because its output can't be
+// saved
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.write(string(l.buf[:i+1]))
+		l.buf = l.buf[i+1:]
+	}
+	if len(l.buf) >= maxLine {
+		l.write(string(l.buf) + "\n")
+		l.buf = nil
+	}
+	return len(p), nil
+}
+
+func (l *lineWriter) write(line string) {
+	l.lines++
+	l.out(l.prefix + line)
+}
+
+func (l *lineWriter) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) > 0 {
+		l.write(string(l.buf) + "\n")
+		l.buf = nil
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	l := &lineWriter{prefix: "> ", out: func(line string) { lines = append(lines, line) }}
+	for _, p := range []string{"a\nb", "c\n", "\n", "d"} {
+		if n, err := l.Write([]byte(p)); n != len(p) || err != nil {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+	if want := []string{"> a\n", "> bc\n", "> \n"}; strings.Join(lines, "") != strings.Join(want, "") {
+		t.Errorf("lines %q, want %q", lines, want)
+	}
+	l.Close()
+	if last := lines[len(lines)-1]; last != "> d\n" {
+		t.Errorf("last line %q", last)
+	}
+
+	lines = nil
+	l.Write([]byte(strings.Repeat("x", maxLine+10)))
+	if len(lines) != 1 || len(lines[0]) != len("> ")+maxLine+11 {
+		t.Errorf("a long line isn't written at once: %d lines", len(lines))
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.log")
+	w, err := newRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	for name, want := range map[string]string{name: "dddddd\n", name + ".1": "cccccc\n", name + ".2": "bbbbbb\n"} {
+		if b, _ := os.ReadFile(name); string(b) != want {
+			t.Errorf("%s has %q, want %q", filepath.Base(name), b, want)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Error("more backups than configured")
+	}
+}
+
+func TestRunOutput(t *testing.T) {
+	dir := t.TempDir()
+	conf := &Config{Rules: []*Rule{{
+		Name:       "r",
+		LocalPaths: []string{dir},
+		PostArgs:   []string{"sh", "-c", "echo one; echo two >&2; printf three; exit 3"},
+		LogFile:    filepath.Join(dir, "out.log"),
+	}}}
+	if err := conf.init(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	r := conf.Rules[0]
+	defer r.output.Close()
+
+	if err := r.run("/d/f", fileVars{}, dir); err == nil {
+		t.Error("exit status 3 is ok")
+	}
+	b, err := os.ReadFile(r.LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	want := []string{"[r] /d/f: one", "[r] /d/f: two", "[r] /d/f: three"}
+	if len(lines) != 4 || strings.Join(lines[:3], "\n") != strings.Join(want, "\n") {
+		t.Fatalf("log file:\n%s", b)
+	}
+	if !strings.HasPrefix(lines[3], "[r] /d/f, started: ") || !strings.HasSuffix(lines[3], "status: exit status 3") {
+		t.Errorf("status line %q", lines[3])
+	}
+}
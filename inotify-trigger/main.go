@@ -1,149 +1,147 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"flag"
-	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"regexp"
-	"strings"
+	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
-	alarm "github.com/wadewyuan/smartom-utils-go"
+	"github.com/wadewyuan/go-tools/fswatch"
 )
 
-type Config struct {
-	LocalEvent string
-
-	LocalPaths []string
-
-	Pattern string
-
-	PostCommand string
-
-	AlarmCode string
-}
-
-var watcher *fsnotify.Watcher
-
-// watchDir gets run as a walk func, searching for directories to add watchers to
-func watchDir(path string, fi os.FileInfo, err error) error {
-
-	// since fsnotify can watch all the files in a directory, watchers only need
-	// to be added to each nested directory
-	if fi.Mode().IsDir() {
-		return watcher.Add(path)
+var watcher *fswatch.Watcher
+
+// dispatch queues the event to every rule that matches it
+func dispatch(event fswatch.Event, conf *Config) {
+	for _, rule := range conf.Rules {
+		rule.stable.Observe(event.Event)
+		if rule.debounce != nil {
+			// Every event keeps the file from being ready, the ops are only
+			// checked once it's quiet
+			if rule.accepts(event.Name) {
+				rule.debounce.add(event)
+			}
+		} else if rule.matches(event) {
+			rule.enqueue(event)
+		}
 	}
-
-	return nil
 }
 
-func postProcess(path string, conf Config) error {
-	matched, err := regexp.MatchString(conf.Pattern, path)
-	if matched {
-		if stat, err := os.Stat(path); err == nil {
-			log.Printf("Processing file: %s, size: %d", path, stat.Size())
-			command := strings.Replace(conf.PostCommand, "$FILE_NAME", path, 1) // Replace the placeholder with file name
-			log.Printf("Command: %s", command)
-			cmd := exec.Command("/bin/bash", "-c", command)
-			if err := cmd.Start(); err != nil {
-				log.Println("Execute failed when Start:" + err.Error())
-			}
-			go func() {
-				cmd.Wait()
-			}()
-
-		} else if errors.Is(err, os.ErrNotExist) {
-			log.Println(err.Error())
-		} else {
-			log.Println(err.Error())
+// rerunFile processes the file with every rule accepting it and reports whether all succeeded
+func rerunFile(path string, conf *Config) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		log.Println("ERROR", err)
+		return false
+	}
+	ok, found := true, false
+	for _, rule := range conf.Rules {
+		if !rule.accepts(path) {
+			continue
 		}
+		found = true
+		event := fswatch.Event{Event: fsnotify.Event{Name: path, Op: fsnotify.Create | fsnotify.CloseWrite}}
+		if err := rule.process(event, true); err != nil {
+			rule.fail(path, err)
+			ok = false
+		}
+	}
+	if !found {
+		log.Printf("No rule matches %s\n", path)
+		return false
 	}
-	return err
+	return ok
 }
 
 func main() {
-	var c string
-	var conf Config
+	var (
+		c           string
+		watchConfig bool
+		failures    time.Duration
+		rerun       string
+	)
 
 	// load configuration file
 	flag.StringVar(&c, "c", "./config.json", "Specify the configuration file.")
+	flag.BoolVar(&watchConfig, "w", false, "Reload the configuration file when it changes, it's always reloaded on SIGHUP.")
+	flag.DurationVar(&failures, "failures", 0, "Show the files which failed in the given period, e.g. 24h, from the ledger then exit.")
+	flag.StringVar(&rerun, "rerun", "", "Run the matching rules for the given file now, even if it was processed already, then exit.")
 	flag.Parse()
-	file, err := os.Open(c)
+	conf, err := loadConfig(c, nil, failures == 0 && len(rerun) == 0)
 	if err != nil {
-		log.Fatal("can't open config file: ", err)
+		log.Fatal(err)
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&conf)
-	if err != nil {
-		log.Fatal("can't decode config JSON: ", err)
+
+	if failures > 0 {
+		if len(conf.LedgerFile) == 0 {
+			log.Fatal("no ledgerfile in the configuration")
+		}
+		if err := printFailures(os.Stdout, conf.LedgerFile, failures); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(rerun) > 0 {
+		if !rerunFile(rerun, conf) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	for _, rule := range conf.Rules {
+		rule.start()
 	}
 
 	// creates a new file watcher
-	watcher, _ = fsnotify.NewWatcher()
+	watcher, err = fswatch.NewWatcher(conf.Watch)
+	if err != nil {
+		log.Fatal("can't create file watcher: ", err)
+	}
 	defer watcher.Close()
 
 	// starting at the root of the project, walk each file/directory searching for
 	// directories
-	for _, p := range conf.LocalPaths {
+	for _, p := range conf.paths() {
 
-		if err := filepath.Walk(p, watchDir); err != nil {
+		if err := watcher.AddTree(p); err != nil {
 			log.Println("ERROR", err)
 		} else {
 			log.Printf("Watching %s\n", p)
 		}
 	}
 
-	//
-	done := make(chan bool)
-
-	//
-	go func() {
-		for {
-			select {
-			// watch for events
-			case event := <-watcher.Events:
-				var op = fsnotify.Create
-				if len(conf.LocalEvent) > 0 {
-					switch conf.LocalEvent {
-					case "CLOSEWRITE":
-						op = fsnotify.CloseWrite
-					case "CREATE":
-						op = fsnotify.Create
-					case "REMOVE":
-						op = fsnotify.Remove
-					case "WRITE":
-						op = fsnotify.Write
-					case "CHMOD":
-						op = fsnotify.Chmod
-					case "RENAME":
-						op = fsnotify.Rename
-					default:
-						op = fsnotify.Create
-					}
-				}
+	// Process the files which arrived while the process was down
+	for _, rule := range conf.Rules {
+		rule.catchUp()
+	}
 
-				if event.Op == op {
-					err := postProcess(event.Name, conf)
-					if err != nil {
-						var msg = fmt.Sprintf("Error processing file: %s ", event.Name)
-						log.Println(msg, err)
-						if len(conf.AlarmCode) > 0 {
-							alarm.SendAlarm(conf.AlarmCode, msg)
-						}
-					}
-				}
-				// watch for errors
-			case err := <-watcher.Errors:
-				log.Println("ERROR", err)
-			}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var changed <-chan struct{}
+	if watchConfig {
+		if changed, err = watchConfigFile(c); err != nil {
+			log.Fatal("can't watch config file: ", err)
 		}
-	}()
+	}
 
-	<-done
+	// Events and reloads are handled in the same goroutine, so the rules are
+	// never switched in the middle of a dispatch
+	for {
+		select {
+		case event := <-watcher.Events:
+			dispatch(event, conf)
+		case err := <-watcher.Errors:
+			log.Println("ERROR", err)
+		case <-hup:
+			log.Println("SIGHUP received, reloading config")
+			conf = reload(c, conf, watcher)
+		case <-changed:
+			log.Println("Config file changed, reloading config")
+			conf = reload(c, conf, watcher)
+		}
+	}
 }
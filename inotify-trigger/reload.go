@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wadewyuan/go-tools/fswatch"
+	alarm "github.com/wadewyuan/smartom-utils-go"
+)
+
+// reload loads the config file again and switches to it, only the paths that
+// were added or removed are watched or unwatched. When the new config is
+// invalid the running one is kept and the alarm is raised.
+func reload(path string, conf *Config, watcher *fswatch.Watcher) *Config {
+	newConf, err := loadConfig(path, conf, true)
+	if err != nil {
+		var msg = fmt.Sprintf("Error reloading config: %s ", path)
+		log.Println(msg, err)
+		if len(conf.AlarmCode) > 0 {
+			alarm.SendAlarm(conf.AlarmCode, msg)
+		}
+		return conf
+	}
+	if !reflect.DeepEqual(conf.Watch, newConf.Watch) {
+		log.Println("Changes of the watch options take effect after a restart")
+	}
+
+	for _, rule := range newConf.Rules {
+		rule.start()
+	}
+
+	removed := make(map[string]bool)
+	for _, p := range conf.paths() {
+		removed[p] = true
+	}
+	var added []string
+	for _, p := range newConf.paths() {
+		if !removed[p] {
+			added = append(added, p)
+		}
+		delete(removed, p)
+	}
+	for p := range removed {
+		watcher.RemoveTree(p)
+		log.Printf("Stopped watching %s\n", p)
+	}
+	if len(removed) > 0 {
+		// A removed path may be below one that is still watched, adding the
+		// trees again restores their watches
+		added = newConf.paths()
+	}
+	for _, p := range added {
+		if err := watcher.AddTree(p); err != nil {
+			log.Println("ERROR", err)
+		} else {
+			log.Printf("Watching %s\n", p)
+		}
+	}
+
+	// Catch up on the files that new or changed rules haven't processed yet,
+	// once the old rules are done with theirs, so no file is queued twice.
+	// The old ledger is closed then, when the new config has another one.
+	go func(old, rules []*Rule, ledger *ledger) {
+		var wg sync.WaitGroup
+		for _, rule := range old {
+			wg.Add(1)
+			go func(rule *Rule) {
+				defer wg.Done()
+				rule.retire()
+			}(rule)
+		}
+		wg.Wait()
+		if ledger != nil && ledger != newConf.ledger {
+			if err := ledger.close(); err != nil {
+				log.Println("ERROR", err)
+			}
+		}
+		for _, rule := range rules {
+			if !unchanged(rule, old) {
+				rule.catchUp()
+			}
+		}
+	}(conf.Rules, newConf.Rules, conf.ledger)
+	log.Printf("Reloaded %s\n", path)
+	return newConf
+}
+
+// unchanged reports whether one of the old rules has the same settings
+func unchanged(rule *Rule, old []*Rule) bool {
+	b, err := json.Marshal(rule)
+	if err != nil {
+		return false
+	}
+	for _, o := range old {
+		if o.Name != rule.Name {
+			continue
+		}
+		ob, err := json.Marshal(o)
+		return err == nil && bytes.Equal(b, ob)
+	}
+	return false
+}
+
+// watchConfigFile signals on the returned channel when the config file has
+// changed. Its directory is watched, since editors often replace the file.
+func watchConfigFile(path string) (<-chan struct{}, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	changed := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		// A save usually comes with several events, wait for them to settle
+		var timer *time.Timer
+		for {
+			select {
+			case event := <-w.Events:
+				if event.Name != path || event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) == 0 {
+					continue
+				}
+				if timer == nil {
+					timer = time.AfterFunc(time.Second, signal)
+				} else {
+					timer.Reset(time.Second)
+				}
+			case err := <-w.Errors:
+				log.Println("ERROR", err)
+			}
+		}
+	}()
+	return changed, nil
+}
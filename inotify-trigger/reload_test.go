@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wadewyuan/go-tools/fswatch"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// closed waits for the ledger file to be closed
+func closed(l *ledger) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		l.mu.Lock()
+		_, err := l.file.Stat()
+		l.mu.Unlock()
+		if errors.Is(err, os.ErrClosed) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	watched := filepath.Join(dir, "in")
+	other := filepath.Join(dir, "other")
+	os.Mkdir(watched, 0755)
+	os.Mkdir(other, 0755)
+	path := filepath.Join(dir, "config.json")
+	writeConfig(t, path, `{"ledgerFile": "`+filepath.Join(dir, "ledger1")+`",
+		"rules": [{"name": "r", "localEvent": ["CLOSEWRITE"], "localPaths": ["`+watched+`"], "pattern": "\\.csv$", "postCommand": "true"}]}`)
+
+	var err error
+	watcher, err = fswatch.NewWatcher(fswatch.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	conf, err := loadConfig(path, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range conf.Rules {
+		r.start()
+	}
+	for _, p := range conf.paths() {
+		if err := watcher.AddTree(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An invalid config keeps the running one
+	writeConfig(t, path, `{"rules": [{"name": "r"}]}`)
+	if got := reload(path, conf, watcher); got != conf {
+		t.Fatal("invalid config replaced the running one")
+	}
+
+	// The same ledger file keeps the ledger open
+	writeConfig(t, path, `{"ledgerFile": "`+filepath.Join(dir, "ledger1")+`",
+		"rules": [{"name": "r", "localEvent": ["CLOSEWRITE"], "localPaths": ["`+watched+`"], "pattern": "\\.txt$", "postCommand": "true"}]}`)
+	same := reload(path, conf, watcher)
+	if same.ledger != conf.ledger {
+		t.Error("ledger reopened for the same file")
+	}
+	if got := same.Rules[0].Pattern; got != `\.txt$` {
+		t.Errorf("pattern = %q after reload, want \\.txt$", got)
+	}
+
+	// Another ledger file closes the old one once the old rules are retired
+	writeConfig(t, path, `{"ledgerFile": "`+filepath.Join(dir, "ledger2")+`",
+		"rules": [{"name": "s", "localEvent": ["CLOSEWRITE"], "localPaths": ["`+other+`"], "pattern": "\\.dat$", "postCommand": "true"}]}`)
+	changed := reload(path, same, watcher)
+	if changed.ledger == same.ledger {
+		t.Fatal("ledger kept after the ledger file changed")
+	}
+	defer changed.ledger.close()
+	if changed.LedgerFile != filepath.Join(dir, "ledger2") {
+		t.Errorf("ledger file = %s, want ledger2", changed.LedgerFile)
+	}
+	if len(changed.Rules) != 1 || changed.Rules[0].Name != "s" || changed.Rules[0].LocalPaths[0] != other {
+		t.Errorf("rules after reload = %+v, want s on %s", changed.Rules[0], other)
+	}
+	if !closed(same.ledger) {
+		t.Error("old ledger still open after the reload")
+	}
+	if _, err := changed.ledger.file.Stat(); err != nil {
+		t.Errorf("new ledger: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ledger2")); err != nil {
+		t.Error(err)
+	}
+	for _, r := range changed.Rules {
+		r.retire()
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Route moves matched files into a directory looked up by a capture group of
+// the rule's pattern, then optionally runs the rule's command in that directory
+type Route struct {
+	// Capture group of Pattern to look up, by name or number
+	Key string
+
+	// Maps the key to a directory, the command runs in it
+	Table map[string]string
+
+	// Directory below the mapped one to put the file in, e.g. "cdr"
+	SubDir string
+
+	// How to put the file into the directory: "move" (default), "copy" or "link"
+	Mode string
+
+	// Files with unknown keys are moved here and an alarm is raised
+	Quarantine string
+}
+
+// Placeholders available to the command of a route
+var routeVarNames = []string{"KEY", "TARGET", "ROUTED"}
+
+func (route *Route) init(r *Rule) error {
+	if len(route.Key) == 0 {
+		return errors.New("route key is required")
+	}
+	found := false
+	for i, name := range r.re.SubexpNames() {
+		if name == route.Key || fmt.Sprint(i) == route.Key {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("route key %s is not a capture group of the pattern", route.Key)
+	}
+	if len(route.Table) == 0 {
+		return errors.New("route table is required")
+	}
+	switch route.Mode {
+	case "":
+		route.Mode = "move"
+	case "move", "copy", "link":
+	default:
+		return fmt.Errorf("unknown route mode: %s", route.Mode)
+	}
+	return nil
+}
+
+// dirLocks serializes the commands run in the same directory across all rules
+var dirLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+func lockDir(dir string) func() {
+	dirLocks.Lock()
+	l, ok := dirLocks.m[dir]
+	if !ok {
+		l = new(sync.Mutex)
+		dirLocks.m[dir] = l
+	}
+	dirLocks.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// route puts the file into the directory of its key and runs the command there
+func (r *Rule) route(path string, vars fileVars) error {
+	key := vars[r.Route.Key]
+	dir, ok := r.Route.Table[key]
+	if !ok {
+		err := fmt.Errorf("no route for key %q", key)
+		if len(r.Route.Quarantine) > 0 {
+			quarantined, qerr := transfer(path, filepath.Join(r.Route.Quarantine, filepath.Base(path)), "move")
+			if qerr != nil {
+				return fmt.Errorf("%v, quarantine failed: %w", err, qerr)
+			}
+			log.Printf("[%s] Quarantined %s as %s", r.Name, path, quarantined)
+		}
+		return err
+	}
+
+	unlock := lockDir(dir)
+	defer unlock()
+
+	target := filepath.Join(dir, r.Route.SubDir)
+	routed, err := transfer(path, filepath.Join(target, filepath.Base(path)), r.Route.Mode)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] Routed %s to %s", r.Name, path, routed)
+
+	if len(r.PostCommand) == 0 && len(r.PostArgs) == 0 {
+		return nil
+	}
+	vars["KEY"] = key
+	vars["TARGET"] = target
+	vars["ROUTED"] = routed
+	return r.run(routed, vars, dir)
+}
+
+// transfer moves, copies or hard links src to dst, creating the directory of
+// dst, and returns the name it got: a file already at dst is never replaced,
+// a number is put before the extension instead, e.g. "a.1.csv"
+func transfer(src, dst, mode string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	switch mode {
+	case "link":
+		return linkUnused(src, dst)
+	case "copy":
+		return copyFile(src, dst)
+	}
+	// A hard link then removing src, as a rename would replace dst
+	name, err := linkUnused(src, dst)
+	if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EPERM) {
+		// Can't link across filesystems or on some of them
+		name, err = copyFile(src, dst)
+	}
+	if err != nil {
+		return "", err
+	}
+	return name, os.Remove(src)
+}
+
+// linkUnused hard links src to dst, or to dst with a number before its
+// extension when there's a file with that name already, and returns the name
+func linkUnused(src, dst string) (string, error) {
+	ext := filepath.Ext(dst)
+	trimmed := strings.TrimSuffix(dst, ext)
+	name := dst
+	for i := 1; ; i++ {
+		err := os.Link(src, name)
+		if !errors.Is(err, os.ErrExist) {
+			if err != nil {
+				return "", err
+			}
+			return name, nil
+		}
+		name = fmt.Sprintf("%s.%d%s", trimmed, i, ext)
+	}
+}
+
+// copyFile copies src to a temporary file next to dst then links it in, so the
+// file never shows up half-written under its final name
+func copyFile(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp := filepath.Join(filepath.Dir(dst), ".writing"+filepath.Base(dst))
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err = out.Close(); err != nil {
+		return "", err
+	}
+	return linkUnused(tmp, dst)
+}
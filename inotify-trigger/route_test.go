@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// routeRule returns a rule routing the files of in by the gateway in their
+// name, to the a and b directories of dir
+func routeRule(t *testing.T, dir, mode, command string) *Rule {
+	t.Helper()
+	conf := &Config{Rules: []*Rule{{
+		Name:        "r",
+		LocalPaths:  []string{filepath.Join(dir, "in")},
+		Pattern:     `cdr_(?P<gw>\w+?)_`,
+		Action:      "route",
+		PostCommand: command,
+		Route: Route{
+			Key:        "gw",
+			Table:      map[string]string{"gw1": filepath.Join(dir, "a"), "gw2": filepath.Join(dir, "b")},
+			SubDir:     "cdr",
+			Mode:       mode,
+			Quarantine: filepath.Join(dir, "unknown"),
+		},
+	}}}
+	if err := conf.init(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	return conf.Rules[0]
+}
+
+// routeFile writes a file into the in directory and routes it
+func routeFile(t *testing.T, r *Rule, dir, name string) (string, error) {
+	t.Helper()
+	path := filepath.Join(dir, "in", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, r.route(path, newFileVars(path, 0, nil, r.re))
+}
+
+func TestRoute(t *testing.T) {
+	dir := t.TempDir()
+	r := routeRule(t, dir, "", `echo ${KEY} ${TARGET} ${ROUTED} "$PWD" > ../ran`)
+
+	path, err := routeFile(t, r, dir, "cdr_gw2_1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("file isn't moved")
+	}
+	routed := filepath.Join(dir, "b", "cdr", "cdr_gw2_1.csv")
+	if b, err := os.ReadFile(routed); err != nil || string(b) != "cdr_gw2_1.csv" {
+		t.Errorf("routed file: %q, %v", b, err)
+	}
+	// The command runs in the mapped directory, not the subdirectory
+	b, err := os.ReadFile(filepath.Join(dir, "ran"))
+	if err != nil {
+		t.Fatal("command didn't run in the routed directory: ", err)
+	}
+	if want := strings.Join([]string{"gw2", filepath.Join(dir, "b", "cdr"), routed, filepath.Join(dir, "b")}, " ") + "\n"; string(b) != want {
+		t.Errorf("command wrote %q, want %q", b, want)
+	}
+}
+
+func TestRouteUnknown(t *testing.T) {
+	dir := t.TempDir()
+	r := routeRule(t, dir, "", "")
+
+	path, err := routeFile(t, r, dir, "cdr_gw9_1.csv")
+	if err == nil || !strings.Contains(err.Error(), `"gw9"`) {
+		t.Errorf("unknown key: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("file isn't moved")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unknown", "cdr_gw9_1.csv")); err != nil {
+		t.Error("file isn't quarantined: ", err)
+	}
+}
+
+func TestRouteModes(t *testing.T) {
+	for _, mode := range []string{"copy", "link"} {
+		dir := t.TempDir()
+		r := routeRule(t, dir, mode, "")
+		path, err := routeFile(t, r, dir, "cdr_gw1_1.csv")
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		src, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("%s: source is gone: %v", mode, err)
+		}
+		dst, err := os.Stat(filepath.Join(dir, "a", "cdr", "cdr_gw1_1.csv"))
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if same := os.SameFile(src, dst); same != (mode == "link") {
+			t.Errorf("%s: same file is %t", mode, same)
+		}
+		if left, _ := filepath.Glob(filepath.Join(dir, "a", "cdr", ".writing*")); len(left) > 0 {
+			t.Errorf("%s: temporary files left: %v", mode, left)
+		}
+	}
+}
+
+func TestRouteExisting(t *testing.T) {
+	for _, mode := range []string{"move", "copy", "link"} {
+		dir := t.TempDir()
+		r := routeRule(t, dir, mode, "")
+		existing := filepath.Join(dir, "a", "cdr", "cdr_gw1_1.csv")
+		os.MkdirAll(filepath.Dir(existing), 0755)
+		if err := os.WriteFile(existing, []byte("existing"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"cdr_gw1_1.1.csv", "cdr_gw1_1.2.csv"} {
+			if _, err := routeFile(t, r, dir, "cdr_gw1_1.csv"); err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "a", "cdr", want)); err != nil {
+				t.Errorf("%s: %v", mode, err)
+			}
+		}
+		if b, err := os.ReadFile(existing); err != nil || string(b) != "existing" {
+			t.Errorf("%s: existing file is %q, %v", mode, b, err)
+		}
+		if left, _ := filepath.Glob(filepath.Join(dir, "a", "cdr", ".writing*")); len(left) > 0 {
+			t.Errorf("%s: temporary files left: %v", mode, left)
+		}
+	}
+
+	// Nor is a quarantined file replaced
+	dir := t.TempDir()
+	r := routeRule(t, dir, "", "")
+	for i := 0; i < 2; i++ {
+		routeFile(t, r, dir, "cdr_gw9_1.csv")
+	}
+	got, _ := filepath.Glob(filepath.Join(dir, "unknown", "*"))
+	want := []string{filepath.Join(dir, "unknown", "cdr_gw9_1.1.csv"), filepath.Join(dir, "unknown", "cdr_gw9_1.csv")}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("quarantined %v, want %v", got, want)
+	}
+}
+
+func TestRouteInit(t *testing.T) {
+	tests := []struct {
+		route Route
+		ok    bool
+	}{
+		{Route{Key: "gw", Table: map[string]string{"gw1": "/a"}}, true},
+		{Route{Key: "1", Table: map[string]string{"gw1": "/a"}}, true},
+		{Route{Key: "2", Table: map[string]string{"gw1": "/a"}}, false},
+		{Route{Key: "host", Table: map[string]string{"gw1": "/a"}}, false},
+		{Route{Key: "gw"}, false},
+		{Route{Key: "gw", Table: map[string]string{"gw1": "/a"}, Mode: "symlink"}, false},
+	}
+	for _, tt := range tests {
+		conf := &Config{Rules: []*Rule{{LocalPaths: []string{"/in"}, Pattern: `cdr_(?P<gw>\w+?)_`, Action: "route", Route: tt.route}}}
+		if err := conf.init(nil, true); (err == nil) != tt.ok {
+			t.Errorf("%+v: %v", tt.route, err)
+		}
+	}
+}
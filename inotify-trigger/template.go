@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Placeholders supported in PostCommand and PostArgs:
+//
+//	${FILE}   full path of the file, $FILE_NAME is kept as an alias
+//	${NAME}   base name of the file
+//	${DIR}    directory of the file
+//	${EXT}    extension of the file including the dot, e.g. ".csv"
+//	${OP}     the event op, e.g. CLOSE_WRITE
+//	${SIZE}   file size in bytes
+//	${MTIME}  modification time as yyyyMMddHHmmss
+//	${0}..${n} and ${group}  capture groups of the rule's pattern
+//
+// and for the "route" action:
+//
+//	${KEY}     the looked up key
+//	${TARGET}  directory the file was put in
+//	${ROUTED}  new path of the file
+//
+// In PostCommand a placeholder can be written bare or within quotes, e.g.
+// ${FILE} or "${FILE}", bash gets the value as is either way.
+var placeholder = regexp.MustCompile(`\$\{(\w+)\}|\$FILE_NAME\b`)
+
+var fileVarNames = []string{"FILE", "NAME", "DIR", "EXT", "OP", "SIZE", "MTIME"}
+
+// fileVars holds the placeholder values for a single file
+type fileVars map[string]string
+
+func newFileVars(path string, op fsnotify.Op, fi os.FileInfo, re *regexp.Regexp) fileVars {
+	v := fileVars{
+		"FILE": path,
+		"NAME": filepath.Base(path),
+		"DIR":  filepath.Dir(path),
+		"EXT":  filepath.Ext(path),
+		"OP":   op.String(),
+	}
+	if fi != nil {
+		v["SIZE"] = strconv.FormatInt(fi.Size(), 10)
+		v["MTIME"] = fi.ModTime().Format("20060102150405")
+	}
+	if match := re.FindStringSubmatch(path); match != nil {
+		for i, name := range re.SubexpNames() {
+			v[strconv.Itoa(i)] = match[i]
+			if len(name) > 0 {
+				v[name] = match[i]
+			}
+		}
+	}
+	return v
+}
+
+// expand replaces the placeholders in tmpl, passing every value through quote
+func (v fileVars) expand(tmpl string, quote func(string) string) string {
+	return placeholder.ReplaceAllStringFunc(tmpl, func(s string) string {
+		name := "FILE"
+		if m := placeholder.FindStringSubmatch(s); len(m[1]) > 0 {
+			name = m[1]
+		}
+		return quote(v[name])
+	})
+}
+
+// checkTemplate makes sure every placeholder in tmpl can be resolved for re
+// and the extra names of the rule's action
+func checkTemplate(tmpl string, re *regexp.Regexp, extra []string) error {
+	known := make(map[string]bool)
+	for _, name := range append(fileVarNames, extra...) {
+		known[name] = true
+	}
+	for i, name := range re.SubexpNames() {
+		known[strconv.Itoa(i)] = true
+		if len(name) > 0 {
+			known[name] = true
+		}
+	}
+	for _, m := range placeholder.FindAllStringSubmatch(tmpl, -1) {
+		if len(m[1]) > 0 && !known[m[1]] {
+			return fmt.Errorf("unknown placeholder: %s", m[0])
+		}
+	}
+	return nil
+}
+
+// shellQuote wraps s in single quotes so bash takes it literally
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellExpand replaces the placeholders in a bash command line so bash takes
+// every value literally. A bare placeholder is wrapped in single quotes, one
+// already in quotes, like "$FILE_NAME" in the older configs, is escaped for
+// those quotes instead, so they don't end up in the value.
+func (v fileVars) shellExpand(tmpl string) string {
+	var b strings.Builder
+	var quote byte // ' or " while inside quotes
+	escaped := false
+	scan := func(s string) {
+		for i := 0; i < len(s); i++ {
+			c := s[i]
+			switch {
+			case escaped:
+				escaped = false
+			case quote == '\'':
+				if c == '\'' {
+					quote = 0
+				}
+			case c == '\\':
+				escaped = true
+			case quote == '"':
+				if c == '"' {
+					quote = 0
+				}
+			case c == '\'' || c == '"':
+				quote = c
+			}
+		}
+		b.WriteString(s)
+	}
+
+	last := 0
+	for _, m := range placeholder.FindAllStringSubmatchIndex(tmpl, -1) {
+		scan(tmpl[last:m[0]])
+		last = m[1]
+		escaped = false
+		name := "FILE"
+		if m[2] >= 0 {
+			name = tmpl[m[2]:m[3]]
+		}
+		switch quote {
+		case '\'':
+			b.WriteString(strings.ReplaceAll(v[name], "'", `'\''`))
+		case '"':
+			b.WriteString(doubleQuoted.Replace(v[name]))
+		default:
+			b.WriteString(shellQuote(v[name]))
+		}
+	}
+	scan(tmpl[last:])
+	return b.String()
+}
+
+// doubleQuoted escapes the characters bash still interprets in double quotes
+var doubleQuoted = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
+func verbatim(s string) string {
+	return s
+}
+
+// command builds the command to run for a file, either a bash command line
+// with quoted values, see shellExpand, or, when PostArgs is set, an argv
+// executed directly
+func (r *Rule) command(ctx context.Context, v fileVars) *exec.Cmd {
+	if len(r.PostArgs) > 0 {
+		args := make([]string, len(r.PostArgs))
+		for i, a := range r.PostArgs {
+			args[i] = v.expand(a, verbatim)
+		}
+		return exec.CommandContext(ctx, args[0], args[1:]...)
+	}
+	return exec.CommandContext(ctx, "/bin/bash", "-c", v.shellExpand(r.PostCommand))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestShellQuote(t *testing.T) {
+	// bash must get back every value as is
+	for _, s := range []string{"", "a b", "it's", `"$HOME" $(id) ` + "`id`", "a\nb", `\'`, "*"} {
+		out, err := exec.Command("/bin/bash", "-c", "printf %s "+shellQuote(s)).Output()
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if string(out) != s {
+			t.Errorf("bash printed %q for %q", out, s)
+		}
+	}
+}
+
+func TestFileVars(t *testing.T) {
+	re := regexp.MustCompile(`cdr_(?P<gw>\w+)_(\d{8})`)
+	v := newFileVars("/data/in/cdr_gw03_20240102.csv", fsnotify.CloseWrite, nil, re)
+	want := fileVars{
+		"FILE": "/data/in/cdr_gw03_20240102.csv",
+		"NAME": "cdr_gw03_20240102.csv",
+		"DIR":  "/data/in",
+		"EXT":  ".csv",
+		"OP":   "CLOSE_WRITE",
+		"0":    "cdr_gw03_20240102",
+		"1":    "gw03",
+		"2":    "20240102",
+		"gw":   "gw03",
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("vars\n%v\nwant\n%v", v, want)
+	}
+
+	tests := []struct {
+		tmpl  string
+		quote func(string) string
+		want  string
+	}{
+		{"load ${FILE} $FILE_NAME", verbatim, "load /data/in/cdr_gw03_20240102.csv /data/in/cdr_gw03_20240102.csv"},
+		{"${DIR}/${gw}/${2}${EXT}", verbatim, "/data/in/gw03/20240102.csv"},
+		{"$FILE_NAMES ${OP}", verbatim, "$FILE_NAMES CLOSE_WRITE"},
+		{"mv ${FILE} ${DIR}/done", shellQuote, "mv '/data/in/cdr_gw03_20240102.csv' '/data/in'/done"},
+		{"echo ${KEY}", shellQuote, "echo ''"},
+	}
+	for _, tt := range tests {
+		if got := v.expand(tt.tmpl, tt.quote); got != tt.want {
+			t.Errorf("expand(%q) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestShellExpand(t *testing.T) {
+	values := []string{"/in/a b.csv", "/in/it's", `/in/"x" $HOME $(id) ` + "`id`", `/in/back\slash\`, "/in/a\nb", ""}
+	tests := []struct {
+		tmpl string
+		want func(string) string
+	}{
+		{"printf %s ${FILE}", func(s string) string { return s }},
+		{`printf %s "${FILE}"`, func(s string) string { return s }},
+		{`printf %s "$FILE_NAME"`, func(s string) string { return s }},
+		{"printf %s '${FILE}'", func(s string) string { return s }},
+		{`printf %s "file: ${FILE}, name: '${NAME}'"`, func(s string) string { return "file: " + s + ", name: '" + filepath.Base(s) + "'" }},
+		{`printf %s 'it'\''s ${NAME}' "\"" ${FILE}`, func(s string) string { return "it's " + filepath.Base(s) + `"` + s }},
+		{`printf %s \" ${FILE}`, func(s string) string { return `"` + s }},
+	}
+	for _, tt := range tests {
+		for _, s := range values {
+			v := fileVars{"FILE": s, "NAME": filepath.Base(s)}
+			cmd := v.shellExpand(tt.tmpl)
+			out, err := exec.Command("/bin/bash", "-c", cmd).Output()
+			if err != nil {
+				t.Errorf("%s: %v", cmd, err)
+				continue
+			}
+			if want := tt.want(s); string(out) != want {
+				t.Errorf("%s printed %q, want %q", cmd, out, want)
+			}
+		}
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	re := regexp.MustCompile(`cdr_(?P<gw>\w+)_(\d{8})`)
+	tests := []struct {
+		tmpl  string
+		extra []string
+		ok    bool
+	}{
+		{"${FILE} ${NAME} ${DIR} ${EXT} ${OP} ${SIZE} ${MTIME} $FILE_NAME", nil, true},
+		{"${0} ${1} ${2} ${gw}", nil, true},
+		{"${3}", nil, false},
+		{"${host}", nil, false},
+		{"${ROUTED}", nil, false},
+		{"${KEY} ${TARGET} ${ROUTED}", routeVarNames, true},
+		{"$HOME", nil, true}, // left to bash
+	}
+	for _, tt := range tests {
+		if err := checkTemplate(tt.tmpl, re, tt.extra); (err == nil) != tt.ok {
+			t.Errorf("checkTemplate(%q) = %v", tt.tmpl, err)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	v := fileVars{"FILE": "/in/it's a file", "NAME": "it's a file"}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r := &Rule{PostCommand: "printf '%s|' ${FILE} ${NAME}"}
+	if out, err := r.command(ctx, v).Output(); err != nil || string(out) != "/in/it's a file|it's a file|" {
+		t.Errorf("postcommand printed %q, %v", out, err)
+	}
+
+	r = &Rule{PostCommand: "ignored", PostArgs: []string{"printf", "%s|", "${FILE}", "name: ${NAME}"}}
+	cmd := r.command(ctx, v)
+	if want := []string{"printf", "%s|", "/in/it's a file", "name: it's a file"}; !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("postargs %q, want %q", cmd.Args, want)
+	}
+}
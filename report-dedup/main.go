@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/wadewyuan/go-tools/dedup"
+)
+
+type empty struct{}
+
+type Config struct {
+	Profiles []*Profile
+}
+
+// Profile describes a kind of report: which files to scan for the lines of a
+// file to update, and how its lines look
+type Profile struct {
+	Name string
+
+	// Regular expression on the path of a file to update, its named groups
+	// are used in Scan. Files which don't match are skipped. Any file matches
+	// when empty.
+	FileName string
+
+	// Glob of the files to scan for a file to update, "{name}" is replaced
+	// with the group of that name in FileName and "{scan}" with the -scan
+	// flag, default "{scan}"
+	Scan string
+
+	// Token matching any text in a line, e.g. any value of a column,
+	// default "OTHER"
+	Wildcard string
+
+	// Characters which aren't regular expressions in the lines, for the
+	// regex engine, e.g. "?"
+	Quote string
+
+	// Summary written after the lines left, %d is their number, default
+	// "There are %d SMS CDRs in all."
+	Summary string
+
+	// Number of lines at the start of a file which are copied as they are
+	HeaderLines int
+
+	// Lines starting with one of these are dropped, the summary is written
+	// anew, default ["There"]
+	FooterPrefixes []string
+
+	re   *regexp.Regexp
+	opts dedup.Options
+}
+
+// defaultProfiles are the reports of the tools report-dedup replaces, used
+// when no profile of the same name is configured: "sms" of
+// smsreport-remove-dups, the default, and "ctk" of ctk-report-fix
+var defaultProfiles = []Profile{
+	{
+		Name:           "sms",
+		Scan:           "{scan}",
+		Wildcard:       "OTHER",
+		Summary:        "There are %d SMS CDRs in all.",
+		FooterPrefixes: []string{"There"},
+	},
+	{
+		Name:           "ctk",
+		FileName:       `.*(?P<type>[s|f|a][i|o]_[SD]).*_(?P<date>\d{8}?).*`,
+		Scan:           "*{type}{scan}{date}*",
+		Wildcard:       "OTHER",
+		Quote:          "?",
+		Summary:        "There are %d SMS CDRs in all.",
+		FooterPrefixes: []string{"There"},
+	},
+}
+
+// initProfile returns the profile of the name, configured or built in,
+// default "sms"
+func initProfile(configured []*Profile, name string) (*Profile, error) {
+	if len(name) == 0 {
+		name = "sms"
+	}
+	var p *Profile
+	for _, c := range configured {
+		if c.Name == name {
+			p = c
+			break
+		}
+	}
+	if p == nil {
+		for i := range defaultProfiles {
+			if defaultProfiles[i].Name == name {
+				d := defaultProfiles[i]
+				p = &d
+				break
+			}
+		}
+	}
+	if p == nil {
+		return nil, fmt.Errorf("unknown profile: %s, the profiles are %s", name, strings.Join(profileNames(configured), ", "))
+	}
+	if err := p.init(); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	return p, nil
+}
+
+// profileNames returns the names of the configured and built-in profiles
+func profileNames(configured []*Profile) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, p := range configured {
+		names = append(names, p.Name)
+		seen[p.Name] = true
+	}
+	for _, p := range defaultProfiles {
+		if !seen[p.Name] {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// loadConfig reads the config file, a missing one is an empty config unless
+// required
+func loadConfig(path string, required bool) (*Config, error) {
+	var conf Config
+	file, err := os.Open(path)
+	if os.IsNotExist(err) && !required {
+		return &conf, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open config file: %w", err)
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&conf); err != nil {
+		return nil, fmt.Errorf("can't decode config JSON: %w", err)
+	}
+	return &conf, nil
+}
+
+func (p *Profile) init() error {
+	var err error
+	if p.re, err = regexp.Compile(p.FileName); err != nil {
+		return err
+	}
+	if len(p.Scan) == 0 {
+		p.Scan = "{scan}"
+	}
+	if len(p.Summary) == 0 {
+		p.Summary = "There are %d SMS CDRs in all."
+	}
+	if p.FooterPrefixes == nil {
+		p.FooterPrefixes = []string{"There"}
+	}
+	p.opts = dedup.Options{Wildcard: p.Wildcard, Quote: p.Quote}
+	return nil
+}
+
+// scanPattern returns the glob of the files to scan for the file to update
+func (p *Profile) scanPattern(path, scan string) (string, error) {
+	match := p.re.FindStringSubmatch(path)
+	if match == nil {
+		return "", errors.New("file name doesn't match " + p.FileName)
+	}
+	pattern := strings.Replace(p.Scan, "{scan}", scan, -1)
+	for i, name := range p.re.SubexpNames() {
+		if len(name) > 0 {
+			pattern = strings.Replace(pattern, "{"+name+"}", match[i], -1)
+		}
+	}
+	return pattern, nil
+}
+
+// footer reports whether the line is dropped
+func (p *Profile) footer(line string) bool {
+	for _, prefix := range p.FooterPrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var profile *Profile
+
+var (
+	engine  string
+	compare bool
+
+	// Indexes of the files to scan by their glob pattern, shared by the
+	// files to update with the same pattern
+	indexes   = make(map[string]*dedup.Index)
+	indexesMu sync.Mutex
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func processFile(path string, scan string) (filename string, err error) {
+	log.Println("Updating " + path)
+	// Step 1. Build the pattern of the files to scan from the file name, e.g.
+	// the report type and date of CTK_IP_so_SM_ALL_202105280000
+	p, err := profile.scanPattern(path, scan)
+	if err != nil {
+		return "", err
+	}
+
+	// Step 2. Open the file to update and read line by line
+	f, e := os.Open(path)
+	if e != nil {
+		return "", e
+	}
+	defer f.Close()
+
+	newFile, err := os.Create(path + ".new")
+	check(err)
+	defer newFile.Close()
+	// Create a writer
+	w := bufio.NewWriter(newFile)
+
+	// Step 3. Index the lines of the files to scan, or grep them for each line
+	m, err := matcher(p)
+	check(err)
+
+	scanner := bufio.NewScanner(f)
+	count := 0
+	n := 0
+	failed := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		n++
+		if n <= profile.HeaderLines {
+			w.WriteString(line + "\n")
+			continue
+		}
+		if profile.footer(line) || len(line) < 1 {
+			// Skip empty lines and the last line of summary
+			continue
+		}
+		// Step 4. Look the line up, the wildcard matching anything
+		found, err := m.Contains(line)
+		if err != nil {
+			// The regex engine fails on lines which aren't regular
+			// expressions, e.g. "+852...", they're kept
+			log.Printf("File: %s, can't look up line %d: %s\n", path, n, err)
+			failed++
+		}
+		// Only write the records which are not found in other files to the new file
+		if !found {
+			count++
+			w.WriteString(line + "\n")
+		}
+	}
+	if failed > 0 {
+		log.Printf("File: %s, %d lines couldn't be looked up and are kept\n", path, failed)
+	}
+	if c, ok := m.(*dedup.Compare); ok && c.Diffs > 0 {
+		log.Printf("File: %s, %d lines found differently by the engines\n", path, c.Diffs)
+	}
+	if count > 0 {
+		w.WriteString("\n")
+		w.WriteString(fmt.Sprintf(profile.Summary, count) + "\n")
+	}
+	w.Flush()
+
+	return path, nil
+}
+
+// matcher returns how the lines are looked up in the files of the pattern
+func matcher(pattern string) (dedup.Matcher, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	re := dedup.NewRegex(files, profile.opts)
+	if engine == "regex" && !compare {
+		return re, nil
+	}
+
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	x, ok := indexes[pattern]
+	if !ok {
+		if x, err = dedup.NewIndex(files, profile.opts); err != nil {
+			return nil, err
+		}
+		log.Printf("Indexed %d lines of %d files for %s\n", x.Len(), len(files), pattern)
+		indexes[pattern] = x
+	}
+	switch {
+	case compare && engine == "regex":
+		return &dedup.Compare{A: re, B: x}, nil
+	case compare:
+		return &dedup.Compare{A: x, B: re}, nil
+	}
+	return x, nil
+}
+
+func renameFile(path string) {
+	// Rename the files after update
+	os.Rename(path, "."+path+".old")
+	os.Rename(path+".new", path)
+	log.Println("Updated " + path)
+}
+
+func main() {
+	var (
+		c                  string
+		name               string
+		scanFilesPattern   string
+		updateFilesPattern string
+		workPath           string
+	)
+
+	flag.StringVar(&c, "c", "./config.json", "Specify the configuration file, the built-in profiles are used without one.")
+	flag.StringVar(&name, "profile", "sms", "Name of the profile of the reports: \"sms\" as smsreport-remove-dups, \"ctk\" as ctk-report-fix, or one of the configuration file.")
+	flag.StringVar(&scanFilesPattern, "scan", "", "Files to scan")
+	flag.StringVar(&updateFilesPattern, "update", "", "Files to update")
+	flag.StringVar(&workPath, "work-path", ".", "Files to update")
+	flag.StringVar(&engine, "engine", "index", "How the lines are looked up in the files to scan: \"index\" looks them up in memory, \"regex\" searches each line as a regular expression in every file as before, e.g. if a line depends on \".\" matching any character.")
+	flag.BoolVar(&compare, "compare", false, "Look the lines up with both engines and log the lines they disagree on, the result is the one of -engine.")
+
+	flag.Parse()
+
+	if engine != "index" && engine != "regex" {
+		log.Panic("Unknown engine: " + engine)
+	}
+
+	// The config file is optional unless given
+	required := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "c" {
+			required = true
+		}
+	})
+	conf, err := loadConfig(c, required)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if profile, err = initProfile(conf.Profiles, name); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(scanFilesPattern) <= 0 {
+		log.Panic("Please specify the files to scan.")
+	}
+	if len(updateFilesPattern) <= 0 {
+		log.Panic("Please specify the files to update.")
+	}
+
+	log.Printf("Profile: %s\n", profile.Name)
+	log.Printf("Work path: %s\n", workPath)
+	log.Printf("Files to scan: %s\n", scanFilesPattern)
+	log.Printf("Files to update: %s\n", updateFilesPattern)
+
+	err = os.Chdir(workPath)
+	check(err)
+	matches, err := filepath.Glob(updateFilesPattern)
+	check(err)
+
+	sem := make(chan empty, len(matches)) // semaphore pattern
+	for _, f := range matches {
+		go func(f string) {
+			if _, err := processFile(f, scanFilesPattern); err != nil {
+				log.Printf("Error processing file: %s, %s\n", f, err)
+			} else {
+				renameFile(f)
+			}
+			sem <- empty{}
+		}(f)
+	}
+	// wait for goroutines to finish
+	for range matches {
+		<-sem
+	}
+}
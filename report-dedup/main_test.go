@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wadewyuan/go-tools/dedup"
+)
+
+func TestScanPattern(t *testing.T) {
+	tests := []struct {
+		profile, path, scan, want string
+	}{
+		{"sms", "/reports/SMS_20210528.csv", "/scan/*.csv", "/scan/*.csv"},
+		{"ctk", "CTK_IP_so_SM_ALL_202105280000", "M_ALL_", "*so_SM_ALL_20210528*"},
+		{"ctk", "/r/CTK_IP_fi_D_OTHER_202112310000.csv", "_", "*fi_D_20211231*"},
+		{"ctk", "/r/CTK_IP_summary.csv", "_", ""},
+	}
+	for _, tt := range tests {
+		p, err := initProfile(nil, tt.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.scanPattern(tt.path, tt.scan)
+		if len(tt.want) == 0 {
+			if err == nil {
+				t.Errorf("%s: %s matches", tt.profile, tt.path)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: scan pattern of %s is %q, %v, want %q", tt.profile, tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestFooter(t *testing.T) {
+	p, _ := initProfile(nil, "")
+	for line, want := range map[string]bool{"There are 3 SMS CDRs in all.": true, "Therefore,1": true, "85291234567,CSL": false, " There": false} {
+		if got := p.footer(line); got != want {
+			t.Errorf("footer(%q) = %t", line, got)
+		}
+	}
+	p = &Profile{FooterPrefixes: []string{}}
+	p.init()
+	if p.footer("There are 3 SMS CDRs in all.") {
+		t.Error("lines dropped without footer prefixes")
+	}
+}
+
+func TestInitProfile(t *testing.T) {
+	p, err := initProfile(nil, "")
+	if err != nil || p.Name != "sms" {
+		t.Fatalf("default profile %v, %v", p, err)
+	}
+	configured := []*Profile{{Name: "sms", Scan: "*{scan}", HeaderLines: 2}, {Name: "hkt", Scan: "{scan}"}}
+	if p, _ = initProfile(configured, "sms"); p.Scan != "*{scan}" || p.Summary != "There are %d SMS CDRs in all." {
+		t.Errorf("configured profile %+v doesn't replace the built-in one", p)
+	}
+	if p, _ = initProfile(configured, "ctk"); p.Quote != "?" {
+		t.Errorf("built-in ctk profile %+v", p)
+	}
+	_, err = initProfile(configured, "xyz")
+	if err == nil || !strings.HasSuffix(err.Error(), "the profiles are sms, hkt, ctk") {
+		t.Errorf("unknown profile: %v", err)
+	}
+	if _, err = initProfile([]*Profile{{Name: "bad", FileName: "("}}, "bad"); err == nil {
+		t.Error("invalid file name accepted")
+	}
+}
+
+// The profiles of the shipped configuration are the built-in ones
+func TestConfigProfiles(t *testing.T) {
+	conf, err := loadConfig("config.json", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var builtin []*Profile
+	for i := range defaultProfiles {
+		builtin = append(builtin, &defaultProfiles[i])
+	}
+	if !reflect.DeepEqual(conf.Profiles, builtin) {
+		b, _ := json.Marshal(builtin)
+		c, _ := json.Marshal(conf.Profiles)
+		t.Errorf("config.json\n%s\nbuilt-in\n%s", c, b)
+	}
+
+	if conf, err = loadConfig(filepath.Join(t.TempDir(), "none.json"), false); err != nil || len(conf.Profiles) > 0 {
+		t.Errorf("missing optional config: %v, %v", conf, err)
+	}
+	if _, err = loadConfig(filepath.Join(t.TempDir(), "none.json"), true); err == nil {
+		t.Error("missing config accepted")
+	}
+}
+
+func writeFile(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// processFile drops the lines found in the scanned files, with both built-in
+// profiles and both engines
+func TestProcessFile(t *testing.T) {
+	defer func(p *Profile, e string) { profile, engine = p, e }(profile, engine)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	tests := []struct {
+		profile *Profile
+		name    string // of the file to update
+		scan    string
+		files   map[string][]string // scanned
+		lines   []string
+		want    []string
+	}{
+		{
+			profile: &defaultProfiles[0],
+			name:    "SMS_20210528.csv",
+			scan:    "scan/*.csv",
+			files: map[string][]string{
+				"scan/a.csv": {"85291234567,CSL,HK,5", "There are 1 SMS CDRs in all."},
+				"scan/b.csv": {"85291234568,PCCW,HK,6"},
+			},
+			lines: []string{"85291234567,CSL,HK,5", "85291234568,OTHER,HK,6", "85291234569,SMT,HK,1", "", "There are 3 SMS CDRs in all."},
+			want:  []string{"85291234569,SMT,HK,1", "", "There are 1 SMS CDRs in all."},
+		},
+		{
+			profile: &defaultProfiles[1],
+			name:    "CTK_IP_so_SM_ALL_202105280000",
+			scan:    "M_HUB_",
+			files: map[string][]string{
+				"CTK_IP_si_SM_HUB_202105280000": {"a?,1"},              // another type
+				"CTK_IP_so_SM_HUB_202105270000": {"85291234567,CSL,2"}, // another day
+				"CTK_IP_so_SM_HUB_202105281200": {"85291234568,CSL,3", "b?,4"},
+			},
+			lines: []string{"85291234567,CSL,2", "85291234568,OTHER,3", "a?,1", "b?,4"},
+			want:  []string{"85291234567,CSL,2", "a?,1", "", "There are 2 SMS CDRs in all."},
+		},
+		{
+			// A header, and nothing left
+			profile: &Profile{Name: "header", Scan: "{scan}", HeaderLines: 2},
+			name:    "report.csv",
+			scan:    "scan.csv",
+			files:   map[string][]string{"scan.csv": {"1,2", "3,4"}},
+			lines:   []string{"Report of 20210528", "MSISDN,COUNT", "1,2", "3,4"},
+			want:    []string{"Report of 20210528", "MSISDN,COUNT"},
+		},
+	}
+	for _, tt := range tests {
+		for _, e := range []string{"index", "regex"} {
+			dir := t.TempDir()
+			os.Mkdir(filepath.Join(dir, "scan"), 0755)
+			for name, lines := range tt.files {
+				writeFile(t, filepath.Join(dir, name), lines...)
+			}
+			path := filepath.Join(dir, tt.name)
+			writeFile(t, path, tt.lines...)
+			// The scan pattern is relative to the work path
+			if err := os.Chdir(dir); err != nil {
+				t.Fatal(err)
+			}
+			indexes = make(map[string]*dedup.Index)
+
+			p := *tt.profile
+			if err := p.init(); err != nil {
+				t.Fatal(err)
+			}
+			profile, engine = &p, e
+			if _, err := processFile(tt.name, tt.scan); err != nil {
+				t.Fatalf("%s, %s: %v", p.Name, e, err)
+			}
+			b, err := os.ReadFile(path + ".new")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Join(tt.want, "\n") + "\n"; string(b) != want {
+				t.Errorf("%s, %s: updated to\n%s\nwant\n%s", p.Name, e, b, want)
+			}
+		}
+	}
+}
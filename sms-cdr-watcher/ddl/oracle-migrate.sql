@@ -0,0 +1,38 @@
+-- Migration of the loading log tables created by earlier versions of
+-- sms-cdr-watcher and smsa2p-bak-watcher, for the built-in profiles of
+-- profiles.go. Run it BEFORE deploying a version writing the columns below,
+-- its inserts and MERGEs fail on the old tables. New installations run
+-- oracle.sql instead.
+
+-- The version of a row, for the "version" conflict policy
+ALTER TABLE SMS_CDR_LOADING_LOG_EXT ADD (VERSION NUMBER(5) DEFAULT 1 NOT NULL);
+ALTER TABLE SMS_A2P_CDR_LOADING_LOG_EXT ADD (VERSION NUMBER(5) DEFAULT 1 NOT NULL);
+
+-- Statistics of the file, written to the table of the cdr profile
+ALTER TABLE SMS_CDR_LOADING_LOG_EXT ADD (
+    RECORDS     NUMBER(10),
+    BAD_LINES   NUMBER(10),
+    HOURS       VARCHAR2(4000), -- JSON, yyyyMMddHH -> records
+    FILE_SIZE   NUMBER(15),
+    FILE_HASH   VARCHAR2(64)    -- SHA-256 in hex
+);
+
+-- The unique keys MERGE relies on. A file may have been logged more than once
+-- before, list the duplicates and delete all but one row of each first:
+--
+--   SELECT GW_TYPE, FILE_NAME, COUNT(*) FROM SMS_CDR_LOADING_LOG_EXT
+--   GROUP BY GW_TYPE, FILE_NAME HAVING COUNT(*) > 1;
+--
+--   DELETE FROM SMS_CDR_LOADING_LOG_EXT WHERE ROWID NOT IN (
+--     SELECT MAX(ROWID) FROM SMS_CDR_LOADING_LOG_EXT GROUP BY GW_TYPE, FILE_NAME);
+--
+--   SELECT FILE_NAME, SEGMENT, COUNT(*) FROM SMS_A2P_CDR_LOADING_LOG_EXT
+--   GROUP BY FILE_NAME, SEGMENT HAVING COUNT(*) > 1;
+--
+--   DELETE FROM SMS_A2P_CDR_LOADING_LOG_EXT WHERE ROWID NOT IN (
+--     SELECT MAX(ROWID) FROM SMS_A2P_CDR_LOADING_LOG_EXT GROUP BY FILE_NAME, SEGMENT);
+--
+-- With the "version" policy create the keys including VERSION instead, as in
+-- oracle.sql.
+CREATE UNIQUE INDEX SMS_CDR_LOADING_LOG_EXT_UK ON SMS_CDR_LOADING_LOG_EXT (GW_TYPE, FILE_NAME);
+CREATE UNIQUE INDEX SMS_A2P_CDR_LOADING_LOG_EXT_UK ON SMS_A2P_CDR_LOADING_LOG_EXT (FILE_NAME, SEGMENT);
@@ -0,0 +1,46 @@
+-- Loading log tables of the built-in profiles of sms-cdr-watcher, see
+-- profiles.go. The times are DATEs, written in the zone of "timezone" in the
+-- db section.
+--
+-- The unique keys are the key of the profiles, which MERGE relies on with the
+-- "overwrite" and "keep" conflict policies. With "version" a file logged
+-- again with other times gets a row per version, create the keys including
+-- VERSION instead (commented out below).
+--
+-- The tables of earlier versions are migrated by oracle-migrate.sql, which
+-- has to run before this version is deployed.
+
+CREATE SEQUENCE sms_cdr_loading_log_seq;
+
+CREATE TABLE SMS_CDR_LOADING_LOG_EXT (
+    ID          NUMBER         NOT NULL,
+    GW_TYPE     NUMBER(3)      NOT NULL,
+    FILE_NAME   VARCHAR2(256)  NOT NULL,
+    MIN_TIME    DATE,
+    MAX_TIME    DATE,
+    CREATE_TIME DATE           DEFAULT SYSDATE,
+    VERSION     NUMBER(5)      DEFAULT 1 NOT NULL,
+    -- Statistics of the file
+    RECORDS     NUMBER(10),
+    BAD_LINES   NUMBER(10),
+    HOURS       VARCHAR2(4000), -- JSON, yyyyMMddHH -> records
+    FILE_SIZE   NUMBER(15),
+    FILE_HASH   VARCHAR2(64),   -- SHA-256 in hex
+    CONSTRAINT SMS_CDR_LOADING_LOG_EXT_PK PRIMARY KEY (ID)
+);
+
+CREATE UNIQUE INDEX SMS_CDR_LOADING_LOG_EXT_UK ON SMS_CDR_LOADING_LOG_EXT (GW_TYPE, FILE_NAME);
+-- CREATE UNIQUE INDEX SMS_CDR_LOADING_LOG_EXT_UK ON SMS_CDR_LOADING_LOG_EXT (GW_TYPE, FILE_NAME, VERSION);
+
+CREATE TABLE SMS_A2P_CDR_LOADING_LOG_EXT (
+    FILE_NAME   VARCHAR2(256)  NOT NULL,
+    FILE_TIME   DATE,
+    MIN_TIME    DATE,
+    MAX_TIME    DATE,
+    SEGMENT     NUMBER(5)      NOT NULL,
+    CREATE_TIME DATE           DEFAULT SYSDATE,
+    VERSION     NUMBER(5)      DEFAULT 1 NOT NULL
+);
+
+CREATE UNIQUE INDEX SMS_A2P_CDR_LOADING_LOG_EXT_UK ON SMS_A2P_CDR_LOADING_LOG_EXT (FILE_NAME, SEGMENT);
+-- CREATE UNIQUE INDEX SMS_A2P_CDR_LOADING_LOG_EXT_UK ON SMS_A2P_CDR_LOADING_LOG_EXT (FILE_NAME, SEGMENT, VERSION);
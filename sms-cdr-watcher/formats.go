@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/wadewyuan/go-tools/decompress"
+)
+
+var DATETIME_LAYOUT1 = "20060102150405"
+var DATETIME_LAYOUT2 = "060102150405008"
+
+// Format describes how to find the delivery time in the lines of a CDR file
+type Format struct {
+	Name string
+
+	// Regular expression on the file name
+	Pattern string
+
+	// "delimited" (the default) splits the line by Separator and takes the
+	// field at Field. "fixed" first cuts the line to the bytes [Start, End)
+	// when it's longer than End, then splits that by Separator if set.
+	Mode      string
+	Separator string
+	Field     int
+	Start     int
+	End       int
+
+	// Layout of the delivery time in Go's time format, and the time zone it's
+	// in, default the timezone of the configuration or UTC
+	Layout   string
+	TimeZone string
+
+	// Gateway type code written to the loading log
+	GwType int
+
+	// Regular expression with a group matching the time in the file name,
+	// default _(\d{14}), and its layout, default 20060102150405
+	FileTime       string
+	FileTimeLayout string
+
+	// Regular expression with a group matching the ID of the gateway in the
+	// file name, default the name up to its time, e.g. cdr_a2pgw03a
+	Gateway string
+
+	re         *regexp.Regexp
+	fileTimeRe *regexp.Regexp
+	gatewayRe  *regexp.Regexp
+	loc        *time.Location
+}
+
+// defaultFormats are the built-in formats, they are checked after the configured ones
+var defaultFormats = []Format{
+	{Name: "A2PGW", Pattern: "cdr_a2pgw0[0-9][a-z]_\\d{14}_\\d{3}", Separator: "|", Field: 1, Layout: DATETIME_LAYOUT1, GwType: 1},                                 // cdr_a2pgw03a_20220117161852_195
+	{Name: "CLASS_40", Pattern: "CDR_P2PGW0[0-9][A-Z]_IP\\d{2}_\\d{14}_\\d{3}", Separator: "|", Field: 22, Layout: DATETIME_LAYOUT1},                               // CDR_P2PGW03A_IP37_20220108132921_161
+	{Name: "TS", Pattern: "TS\\d{2}_\\d{14}_\\d{2}\\.pp", Mode: "fixed", Start: 100, End: 140, Separator: "C", Field: 1, Layout: DATETIME_LAYOUT2},                 // TS04_20211220171812_19.pp
+	{Name: "MMX", Pattern: "MMX_\\d{14}_\\d\\.csv", Mode: "fixed", Start: 100, End: 140, Separator: "C", Field: 1, Layout: DATETIME_LAYOUT2},                       // MMX_20211220155600_1.csv
+	{Name: "HUB", Pattern: "CDR_smshub\\d{2}_\\d{14}_\\d{3}", Separator: "|", Field: 22, Layout: DATETIME_LAYOUT1},                                                 // CDR_smshub05_20211221091606_111
+	{Name: "SMSC", Pattern: "cdr_\\d{2}_smsc\\d{2}[abcd]_\\d{14}_\\d{3}", Mode: "fixed", Start: 100, End: 140, Separator: "C", Field: 1, Layout: DATETIME_LAYOUT2}, // cdr_00_smsc10a_20211225085228_106
+	{Name: "A2P_BAK", Pattern: "cdr_a2pgw0[1234][abcd]_\\d{14}_\\d{3}", Separator: "|", Field: 1, Layout: DATETIME_LAYOUT1},                                        // cdr_a2pgw02b_20190522093400_114, for the a2p-bak profile
+}
+
+// initFormats compiles the configured formats followed by the built-in ones,
+// a configured format replaces the built-in one of the same name. Formats
+// without a time zone are in tz.
+func initFormats(configured []*Format, tz string) ([]*Format, error) {
+	formats := append([]*Format{}, configured...)
+	names := make(map[string]bool)
+	for _, f := range configured {
+		names[f.Name] = true
+	}
+	for i := range defaultFormats {
+		if f := defaultFormats[i]; !names[f.Name] {
+			formats = append(formats, &f)
+		}
+	}
+
+	for _, f := range formats {
+		if len(f.TimeZone) == 0 {
+			f.TimeZone = tz
+		}
+		if err := f.init(); err != nil {
+			return nil, fmt.Errorf("format %s: %w", f.Name, err)
+		}
+	}
+	return formats, nil
+}
+
+func (f *Format) init() error {
+	var err error
+	if f.re, err = regexp.Compile(f.Pattern); err != nil {
+		return err
+	}
+	switch f.Mode {
+	case "":
+		f.Mode = "delimited"
+	case "delimited":
+	case "fixed":
+		if f.Start < 0 || f.End <= f.Start {
+			return errors.New("invalid start and end offsets")
+		}
+	default:
+		return fmt.Errorf("unknown mode: %s", f.Mode)
+	}
+	if f.Mode == "delimited" && len(f.Separator) == 0 {
+		return errors.New("separator is required")
+	}
+	if len(f.Layout) == 0 {
+		return errors.New("layout is required")
+	}
+	if f.loc, err = time.LoadLocation(f.TimeZone); err != nil {
+		return err
+	}
+
+	if len(f.FileTime) == 0 {
+		f.FileTime = `_(\d{14})`
+	}
+	if len(f.FileTimeLayout) == 0 {
+		f.FileTimeLayout = DATETIME_LAYOUT1
+	}
+	if f.fileTimeRe, err = regexp.Compile(f.FileTime); err != nil {
+		return err
+	}
+	if f.fileTimeRe.NumSubexp() != 1 {
+		return errors.New("filetime needs exactly one group")
+	}
+
+	if len(f.Gateway) > 0 {
+		if f.gatewayRe, err = regexp.Compile(f.Gateway); err != nil {
+			return err
+		}
+		if f.gatewayRe.NumSubexp() != 1 {
+			return errors.New("gateway needs exactly one group")
+		}
+	}
+	return nil
+}
+
+// findFormat returns the first format matching the file name without its
+// compression suffix
+func findFormat(formats []*Format, path string) *Format {
+	path = decompress.TrimExt(path)
+	for _, f := range formats {
+		if f.re.MatchString(path) {
+			return f
+		}
+	}
+	return nil
+}
+
+// deliveryTime parses the delivery time from a line, the error tells why the
+// line doesn't have one
+func (f *Format) deliveryTime(line string) (time.Time, error) {
+	if f.Mode == "fixed" {
+		// A line up to End bytes long is taken whole, as it always was
+		if len(line) > f.End {
+			line = line[f.Start:f.End] // Get the time string by fixed length
+		}
+	}
+	if len(f.Separator) > 0 {
+		s := strings.Split(line, f.Separator)
+		if len(s) <= f.Field {
+			return time.Time{}, fmt.Errorf("%d fields, field %d missing", len(s), f.Field)
+		}
+		line = s[f.Field]
+	}
+	t, err := time.ParseInLocation(f.Layout, line, f.loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", line)
+	}
+	return t, nil
+}
+
+// fileTime parses the time in the file name, ok is false when it has none
+func (f *Format) fileTime(name string) (t time.Time, ok bool) {
+	m := f.fileTimeRe.FindStringSubmatch(filepath.Base(decompress.TrimExt(name)))
+	if m == nil {
+		return t, false
+	}
+	t, err := time.ParseInLocation(f.FileTimeLayout, m[1], f.loc)
+	return t, err == nil
+}
+
+// gateway returns the ID of the gateway which sent the file, the file name
+// when there's none in it
+func (f *Format) gateway(name string) string {
+	name = filepath.Base(decompress.TrimExt(name))
+	if f.gatewayRe != nil {
+		if m := f.gatewayRe.FindStringSubmatch(name); m != nil {
+			return m[1]
+		}
+		return name
+	}
+	if m := f.fileTimeRe.FindStringIndex(name); m != nil && m[0] > 0 {
+		return name[:m[0]]
+	}
+	return name
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFormats(t *testing.T, tz string, configured ...*Format) []*Format {
+	t.Helper()
+	formats, err := initFormats(configured, tz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return formats
+}
+
+func formatNamed(formats []*Format, name string) *Format {
+	for _, f := range formats {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func TestDeliveryTime(t *testing.T) {
+	utc := testFormats(t, "")
+	hk := testFormats(t, "Asia/Hong_Kong", &Format{Name: "LONDON", Pattern: "london_", Separator: ",", Field: 2, Layout: "2006-01-02 15:04:05", TimeZone: "Europe/London"})
+
+	fixed := strings.Repeat(" ", 100) + "C220101083000008C" + strings.Repeat(" ", 30)
+	tests := []struct {
+		formats []*Format
+		format  string
+		line    string
+		want    string // RFC 3339, empty when the line has no time
+	}{
+		{utc, "A2PGW", "x|20220117161852|y", "2022-01-17T16:18:52Z"},
+		{hk, "A2PGW", "x|20220117161852|y", "2022-01-17T08:18:52Z"},
+		{hk, "TS", fixed, "2022-01-01T00:30:00Z"},
+		{utc, "TS", fixed, "2022-01-01T08:30:00Z"},
+		// A configured zone is kept, across summer time
+		{hk, "LONDON", "a,b,2024-01-15 12:00:00", "2024-01-15T12:00:00Z"},
+		{hk, "LONDON", "a,b,2024-07-15 12:00:00", "2024-07-15T11:00:00Z"},
+		{utc, "A2PGW", "x", ""},
+		{utc, "A2PGW", "x|2022-01-17|y", ""},
+		{utc, "TS", "short", ""},
+		// A line no longer than End is split whole
+		{utc, "TS", "xC220101083000008C", "2022-01-01T08:30:00Z"},
+	}
+	for _, tt := range tests {
+		got, err := formatNamed(tt.formats, tt.format).deliveryTime(tt.line)
+		if len(tt.want) == 0 {
+			if err == nil {
+				t.Errorf("%s: time %s in %q", tt.format, got, tt.line)
+			}
+			continue
+		}
+		if err != nil || got.UTC().Format(time.RFC3339) != tt.want {
+			t.Errorf("%s: %q is %s, %v, want %s", tt.format, tt.line, got.UTC().Format(time.RFC3339), err, tt.want)
+		}
+	}
+}
+
+func TestFileTime(t *testing.T) {
+	hk := testFormats(t, "Asia/Hong_Kong",
+		&Format{Name: "DAY", Pattern: "day_", Separator: "|", Layout: DATETIME_LAYOUT1, FileTime: `_(\d{8})\.`, FileTimeLayout: "20060102", TimeZone: "UTC"})
+	tests := []struct {
+		format, name, want string
+	}{
+		{"A2PGW", "/in/cdr_a2pgw03a_20220117161852_195", "2022-01-17T08:18:52Z"},
+		{"A2PGW", "/in/cdr_a2pgw03a_20220117161852_195.gz", "2022-01-17T08:18:52Z"},
+		{"DAY", "/in/day_20240102.csv", "2024-01-02T00:00:00Z"},
+		{"DAY", "/in/day_2024.csv", ""},
+	}
+	for _, tt := range tests {
+		got, ok := formatNamed(hk, tt.format).fileTime(tt.name)
+		if ok != (len(tt.want) > 0) || ok && got.UTC().Format(time.RFC3339) != tt.want {
+			t.Errorf("%s: %s is %s, %t, want %q", tt.format, tt.name, got.UTC().Format(time.RFC3339), ok, tt.want)
+		}
+	}
+}
+
+func TestInitFormats(t *testing.T) {
+	formats := testFormats(t, "Asia/Hong_Kong", &Format{Name: "A2PGW", Pattern: "a2p_", Separator: ",", Layout: DATETIME_LAYOUT1})
+	if len(formats) != len(defaultFormats) {
+		t.Errorf("%d formats, the configured one doesn't replace the built-in one", len(formats))
+	}
+	if f := findFormat(formats, "/in/cdr_a2pgw03a_20220117161852_195.gz"); f == nil || f.Name != "A2P_BAK" {
+		t.Errorf("found %v for a built-in name, want A2P_BAK", f)
+	}
+	if f := findFormat(formats, "/in/a2p_1"); f != formats[0] || f.TimeZone != "Asia/Hong_Kong" {
+		t.Errorf("found %v for a configured name", f)
+	}
+
+	for _, f := range []*Format{
+		{Name: "X", Pattern: "(", Separator: ",", Layout: DATETIME_LAYOUT1},
+		{Name: "X", Separator: ",", Layout: DATETIME_LAYOUT1, TimeZone: "Nowhere/Else"},
+		{Name: "X", Separator: ",", Layout: DATETIME_LAYOUT1, FileTime: `_\d+`},
+		{Name: "X", Layout: DATETIME_LAYOUT1},
+		{Name: "X", Mode: "fixed", Start: 10, End: 10, Layout: DATETIME_LAYOUT1},
+	} {
+		if _, err := initFormats([]*Format{f}, ""); err == nil {
+			t.Errorf("%+v is valid", f)
+		}
+	}
+}
+
+// The records are counted by hour of the business time zone, whatever the
+// zone of the file
+func TestStatsHours(t *testing.T) {
+	defer func(loc *time.Location) { business = loc }(business)
+	var err error
+	if business, err = time.LoadLocation("Asia/Hong_Kong"); err != nil {
+		t.Fatal(err)
+	}
+
+	f := formatNamed(testFormats(t, "Europe/London"), "A2PGW")
+	name := filepath.Join(t.TempDir(), "cdr_a2pgw03a_20240701000000_001")
+	lines := "a|20240630235959|x\na|20240701000000|x\n\nbad\na|20240701003000|x\n"
+	if err := os.WriteFile(name, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := readStats(name, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// London is an hour ahead of UTC in summer, Hong Kong eight
+	if want := map[string]int{"2024070106": 1, "2024070107": 2}; !reflect.DeepEqual(stats.Hours, want) {
+		t.Errorf("hours %v, want %v", stats.Hours, want)
+	}
+	if stats.Records != 3 || stats.BadLines != 1 || stats.Size != int64(len(lines)) {
+		t.Errorf("%d records, %d bad lines, %d bytes", stats.Records, stats.BadLines, stats.Size)
+	}
+	if got := stats.Begin.UTC().Format(time.RFC3339) + " " + stats.End.UTC().Format(time.RFC3339); got != "2024-06-30T22:59:59Z 2024-06-30T23:30:00Z" {
+		t.Errorf("begin and end %s", got)
+	}
+}
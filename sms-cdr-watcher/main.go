@@ -1,63 +1,95 @@
 package main
 
 import (
-	"bufio"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
-	"strings"
+	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	_ "github.com/sijms/go-ora"
+	"github.com/wadewyuan/go-tools/cdrstore"
+	"github.com/wadewyuan/go-tools/decompress"
+	"github.com/wadewyuan/go-tools/fswatch"
+	"github.com/wadewyuan/go-tools/stability"
+	"github.com/wadewyuan/go-tools/timewindow"
 )
 
 type Config struct {
-	Db struct {
-		Host     string
-		Port     string
-		Sid      string
-		Username string
-		Password string
-	}
+	// Backend and table of the loading log
+	Db cdrstore.Options
 
 	Paths []string
+
+	// Checks to make sure a file is completely written before reading it
+	Stability stability.Options
+
+	// Filters and polling of the file watcher
+	Watch fswatch.Options
+
+	// Name of the profile, default "cdr"
+	Profile string
+
+	// Profiles, checked before the built-in ones
+	Profiles []*Profile
+
+	// CDR formats, checked before the built-in ones
+	Formats []*Format
+
+	// When a file is invalid and what's done with it
+	Quarantine Quarantine
+
+	// Alarms for silent and lagging gateways, while watching
+	Monitor Monitor
+
+	// Time zone of the CDR times for formats without one, default UTC
+	TimeZone string
+
+	// Time zone the days and hours are counted in, e.g. Asia/Hong_Kong,
+	// default UTC
+	BusinessTimeZone string
 }
 
 //
-var watcher *fsnotify.Watcher
+var watcher *fswatch.Watcher
 var conf *Config
+var profile *Profile
+var formats []*Format
+var store cdrstore.Store
 
-var A2PGW_FILENAME = "cdr_a2pgw0[0-9][a-z]_\\d{14}_\\d{3}"             // cdr_a2pgw03a_20220117161852_195
-var CLASS_40_FILENAME = "CDR_P2PGW0[0-9][A-Z]_IP\\d{2}_\\d{14}_\\d{3}" // CDR_P2PGW03A_IP37_20220108132921_161
-var TS_FILENAME = "TS\\d{2}_\\d{14}_\\d{2}\\.pp"                       // TS04_20211220171812_19.pp
-var MMX_FILENAME = "MMX_\\d{14}_\\d\\.csv"                             // MMX_20211220155600_1.csv
-var HUB_FILENAME = "CDR_smshub\\d{2}_\\d{14}_\\d{3}"                   // CDR_smshub05_20211221091606_111
-var SMSC_FILENAME = "cdr_\\d{2}_smsc\\d{2}[abcd]_\\d{14}_\\d{3}"       // cdr_00_smsc10a_20211225085228_106
-
-var DATETIME_LAYOUT1 = "20060102150405"
-var DATETIME_LAYOUT2 = "060102150405008"
+// Only files with a time in their name in [since, until) are scanned, when set
+var since, until time.Time
 
-func matches(s string, pattern string) bool {
-	matched, _ := regexp.MatchString(pattern, s)
-	return matched
-}
+// The time zone of the days and hours
+var business *time.Location
 
 // main
 func main() {
 	var (
-		c    string
-		scan bool
+		c          string
+		scan       bool
+		sinceStr   string
+		untilStr   string
+		report     string
+		asCSV      bool
+		workers    int
+		checkpoint string
 	)
 
 	// load configuration file
 	flag.StringVar(&c, "c", "./config.json", "Specify the configuration file.")
 	flag.BoolVar(&scan, "s", false, "Run a full scan of all the paths, then load files that are not found in database.")
+	flag.StringVar(&sinceStr, "since", "", "With -s, only scan files with a time in their name from this time, e.g. 2022-01-01 or \"2022-01-01 08:00:00\".")
+	flag.StringVar(&untilStr, "until", "", "With -s, only scan files with a time in their name before this time.")
+	flag.IntVar(&workers, "workers", runtime.NumCPU(), "With -s, the number of files read at the same time.")
+	flag.StringVar(&checkpoint, "checkpoint", "./scan.checkpoint", "With -s, the file keeping the files scanned when the scan is interrupted, to resume from.")
+	flag.StringVar(&report, "report", "", "Print the statistics of the CDR files in the given directory, then exit.")
+	flag.BoolVar(&asCSV, "csv", false, "With -report, print CSV instead of a table.")
 	flag.Parse()
 	file, err := os.Open(c)
 	if err != nil {
@@ -69,196 +101,219 @@ func main() {
 	if err != nil {
 		log.Fatal("can't decode config JSON: ", err)
 	}
+	formats, err = initFormats(conf.Formats, conf.TimeZone)
+	if err != nil {
+		log.Fatal("invalid CDR format: ", err)
+	}
+	profile, formats, err = initProfile(conf.Profiles, conf.Profile, formats)
+	if err != nil {
+		log.Fatal("invalid profile: ", err)
+	}
+	if err := conf.Quarantine.init(); err != nil {
+		log.Fatal("invalid quarantine: ", err)
+	}
+	business, err = time.LoadLocation(conf.BusinessTimeZone)
+	if err != nil {
+		log.Fatal("invalid business time zone: ", err)
+	}
+	if since, err = parseFlagTime(sinceStr); err != nil {
+		log.Fatal("invalid -since: ", err)
+	}
+	if until, err = parseFlagTime(untilStr); err != nil {
+		log.Fatal("invalid -until: ", err)
+	}
+	if len(report) > 0 {
+		if err := printReport(os.Stdout, report, asCSV); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	db, err := cdrstore.Open(conf.Db, profile.Table)
+	if err != nil {
+		log.Fatal("can't open loading log: ", err)
+	}
+	store = cdrstore.NewWriter(db, conf.Db.Batch)
+	defer store.Close()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	if scan {
+		// A signal stops the scan, leaving a checkpoint to resume from
+		if err := scanPaths(conf.Paths, workers, checkpoint, sig); err != nil {
+			log.Println("ERROR", err)
+		}
+		return
+	}
 
 	// creates a new file watcher
-	watcher, _ = fsnotify.NewWatcher()
-	defer watcher.Close()
+	watcher, err = fswatch.NewWatcher(conf.Watch)
+	if err != nil {
+		log.Fatal("can't create file watcher: ", err)
+	}
+
+	// A signal stops the watcher, Run returns and the queued records are
+	// written once the files being read are done
+	go func() {
+		<-sig
+		watcher.Close()
+	}()
 
 	// starting at the root of the project, walk each file/directory searching for
 	// directories
 	for _, p := range conf.Paths {
-		if scan {
-			if err := filepath.Walk(p, scanDir); err != nil {
-				log.Println("ERROR", err)
-			}
+		if err := watcher.AddTree(p); err != nil {
+			log.Println("ERROR", err)
 		} else {
-			if err := filepath.Walk(p, watchDir); err != nil {
-				log.Println("ERROR", err)
-			} else {
-				log.Printf("Watching %s\n", p)
-			}
+			log.Printf("Watching %s\n", p)
 		}
 	}
 
-	if !scan {
-		//
-		done := make(chan bool)
-
-		//
-		go func() {
-			for {
-				select {
-				// watch for events
-				case event := <-watcher.Events:
-					if event.Op == fsnotify.CloseWrite || event.Op == fsnotify.Create {
-						err := readFile(event.Name)
-						if err != nil {
-							log.Printf("Error processing file: %s\n ", event.Name)
-						}
-					}
-					// watch for errors
-				case err := <-watcher.Errors:
-					log.Println("ERROR", err)
-				}
-			}
-		}()
-
-		<-done
-	}
-}
-
-// watchDir gets run as a walk func, searching for directories to add watchers to
-func watchDir(path string, fi os.FileInfo, err error) error {
-
-	// since fsnotify can watch all the files in a directory, watchers only need
-	// to be added to each nested directory
-	if fi.Mode().IsDir() {
-		return watcher.Add(path)
+	checker := stability.NewChecker(conf.Stability)
+	if conf.Monitor.enabled() {
+		conf.Monitor.start()
 	}
 
-	return nil
+	watcher.Run(func(event fswatch.Event) {
+		checker.Observe(event.Event)
+		// Without a wait a created file is read once it's closed, it'd be read
+		// twice and half written on Create
+		if event.Op&fsnotify.CloseWrite != 0 || event.Op&fsnotify.Create != 0 && checker.Enabled() {
+			path := event.Name
+			checker.Handle(path, func(err error) {
+				if err == nil {
+					err = readFile(path)
+				}
+				if err != nil {
+					log.Printf("Error processing file: %s, %s\n", path, err)
+				}
+			})
+		}
+	})
+	checker.Close()
 }
 
-// read cdr file and get the start & end time
+// read cdr file and get the start & end time, and its statistics
 func readFile(path string) error {
-	f, _ := os.Open(path)
-
-	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanLines)
-	var tBegin = time.Time{}
-	var tEnd = time.Time{}
-
-	var separator string
-	var deliveryTimeIdx int
-	var dateTimePattern string
-	var gwType int
-
-	if matches(path, A2PGW_FILENAME) {
-		separator = "|"
-		deliveryTimeIdx = 1
-		dateTimePattern = DATETIME_LAYOUT1
-		gwType = 1
-	} else if matches(path, CLASS_40_FILENAME) {
-		separator = "|"
-		deliveryTimeIdx = 22
-		dateTimePattern = DATETIME_LAYOUT1
-		gwType = 0
-	} else if matches(path, TS_FILENAME) {
-		separator = "C"
-		deliveryTimeIdx = 1
-		dateTimePattern = DATETIME_LAYOUT2
-		gwType = 0
-	} else if matches(path, MMX_FILENAME) {
-		separator = "C"
-		deliveryTimeIdx = 1
-		dateTimePattern = DATETIME_LAYOUT2
-		gwType = 0
-	} else if matches(path, HUB_FILENAME) {
-		separator = "|"
-		deliveryTimeIdx = 22
-		dateTimePattern = DATETIME_LAYOUT1
-		gwType = 0
-	} else if matches(path, SMSC_FILENAME) {
-		separator = "C"
-		deliveryTimeIdx = 1
-		dateTimePattern = DATETIME_LAYOUT2
-		gwType = 0
-	} else {
+	format := findFormat(formats, path)
+	if format == nil {
 		return errors.New("invalid cdr filename: " + path)
 	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if dateTimePattern == DATETIME_LAYOUT2 && len(line) > 140 {
-			line = line[100:140] // Get the time string by fixed length
-		}
-		s := strings.Split(line, separator)
-		if len(s) <= deliveryTimeIdx {
-			continue
-		}
-
-		t, err := time.Parse(dateTimePattern, s[deliveryTimeIdx])
-		if err != nil {
-			continue
-		}
-		if tEnd.IsZero() || t.After(tEnd) {
-			tEnd = t
-		}
-		if tBegin.IsZero() || t.Before(tBegin) {
-			tBegin = t
+	stats, err := readStats(path, format)
+	if err != nil {
+		// Another event of a file moved to quarantine meanwhile
+		if qerr := conf.Quarantine.moved(path); qerr != nil {
+			return qerr
 		}
+		return err
 	}
-	if !tBegin.IsZero() && !tEnd.IsZero() { // Skip empty files
-		err := logFileNameAndTimes(gwType, filepath.Base(f.Name()), tBegin, tEnd)
-		if err != nil {
-			return err
+	if conf.Monitor.enabled() {
+		arrival := time.Now()
+		written := arrival
+		if fi, err := os.Stat(path); err == nil {
+			written = fi.ModTime()
 		}
+		conf.Monitor.observe(format.gateway(path), arrival, written, stats.End)
+	}
+	if err := checkFile(path, stats); err != nil {
+		return err
+	}
+	if stats.Records > 0 { // Skip empty files
+		return logFileNameAndTimes(format, decompress.TrimExt(filepath.Base(path)), stats)
 	}
-
-	f.Close()
 	return nil
 }
 
-func scanDir(path string, fi os.FileInfo, err error) error {
+// missingFiles returns the files which aren't in the loading log yet. Files
+// are logged by their base name, archived files without the compression suffix.
+func missingFiles(paths []string) ([]string, error) {
+	byName := make(map[string][]string)
+	var trimmed []string
+	for _, path := range paths {
+		t := decompress.TrimExt(filepath.Base(path))
+		if _, ok := byName[t]; !ok {
+			trimmed = append(trimmed, t)
+		}
+		byName[t] = append(byName[t], path)
+	}
+	missing, err := store.Missing(trimmed)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	if fi.Mode().IsDir() {
-		log.Printf("Scanning %s\n", fi.Name())
-		var files []string
-		err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-			if !info.IsDir() {
-				files = append(files, filepath.Base(info.Name()))
-			}
-			return nil
-		})
-		if err != nil {
-			log.Panic(err)
+	var files []string
+	for _, t := range missing {
+		files = append(files, byName[t]...)
+	}
+	return files, nil
+}
+
+// filterFiles returns the CDR files among the paths, within -since and -until when set
+func filterFiles(paths []string) []string {
+	var files []string
+	for _, name := range paths {
+		format := findFormat(formats, name)
+		if format == nil {
+			continue
 		}
-		// Skip processing when no files
-		if len(files) == 0 {
-			return nil
+		if !since.IsZero() || !until.IsZero() {
+			t, ok := format.fileTime(name)
+			if !ok || (!since.IsZero() && t.Before(since)) || (!until.IsZero() && !t.Before(until)) {
+				continue
+			}
 		}
+		files = append(files, name)
+	}
+	return files
+}
 
-		for _, f := range files {
-			err = readFile(path + "/" + f)
-			if err != nil {
-				log.Printf("Error processing file: %s\n ", path+"/"+f)
-			}
+// parseFlagTime parses a date or date and time given on the command line in
+// the business time zone, an empty string is the zero time
+func parseFlagTime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	var err error
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02", DATETIME_LAYOUT1, "20060102"} {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, business); err == nil {
+			return t, nil
 		}
 	}
-	return nil
+	return time.Time{}, err
 }
 
-// log the file name, begin and end times into table in oracle DB
-func logFileNameAndTimes(gwType int, filename string, tBegin time.Time, tEnd time.Time) error {
-	log.Printf("Gateway Type: %d, File: %s, Max Time: %s, Min Time: %s", gwType, filename, tEnd.Format(time.RFC3339), tBegin.Format(time.RFC3339))
+// log the file name, begin and end times and the statistics into the loading
+// log. Split into segments, every row has the statistics of the whole file.
+func logFileNameAndTimes(format *Format, filename string, stats *fileStats) error {
+	log.Printf("Gateway Type: %d, File: %s, Max Time: %s, Min Time: %s, Records: %d, Bad Lines: %d", format.GwType, filename, stats.End.Format(time.RFC3339), stats.Begin.Format(time.RFC3339), stats.Records, stats.BadLines)
 
-	conn, err := sql.Open("oracle", "oracle://"+conf.Db.Username+":"+conf.Db.Password+"@"+conf.Db.Host+":"+conf.Db.Port+"/"+conf.Db.Sid)
-	if err != nil {
-		return err
+	fileTime, ok := format.fileTime(filename)
+	if !ok {
+		log.Printf("Failed to parse time from file name: %s\n", filename)
 	}
-	defer conn.Close()
-
-	stmt, err := conn.Prepare("INSERT INTO SMS_CDR_LOADING_LOG_EXT VALUES(sms_cdr_loading_log_seq.nextval, :1, :2, :3, :4, SYSDATE, null)")
-	if err != nil {
-		return err
+	segments := []timewindow.Segment{{Begin: stats.Begin, End: stats.End, Index: 1}}
+	if profile.splitter != nil {
+		var err error
+		if segments, err = profile.splitter.Split(stats.Begin.In(business), stats.End); err != nil {
+			return err
+		}
 	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(gwType, filename, tBegin, tEnd)
-	if err != nil {
-		return err
+	var records []*cdrstore.Record
+	for _, seg := range segments {
+		records = append(records, &cdrstore.Record{
+			GwType:   format.GwType,
+			FileName: filename,
+			FileTime: fileTime,
+			Begin:    seg.Begin,
+			End:      seg.End,
+			Segment:  seg.Index,
+			Records:  stats.Records,
+			BadLines: stats.BadLines,
+			Hours:    stats.Hours,
+			Size:     stats.Size,
+			Hash:     stats.Hash,
+		})
 	}
-	return nil
+	return store.Log(records...)
 }
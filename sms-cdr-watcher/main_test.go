@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wadewyuan/go-tools/cdrstore"
+)
+
+// setGlobals sets the globals of the scan for a test, restoring them after
+func setGlobals(t *testing.T, tz string) {
+	t.Helper()
+	oldFormats, oldStore, oldSince, oldUntil, oldBusiness := formats, store, since, until, business
+	t.Cleanup(func() {
+		formats, store, since, until, business = oldFormats, oldStore, oldSince, oldUntil, oldBusiness
+	})
+	var err error
+	if business, err = time.LoadLocation(tz); err != nil {
+		t.Fatal(err)
+	}
+	formats = testFormats(t, tz)
+	since, until = time.Time{}, time.Time{}
+}
+
+func TestParseFlagTime(t *testing.T) {
+	setGlobals(t, "Asia/Hong_Kong")
+	tests := []struct {
+		flag, want string
+	}{
+		{"", "0001-01-01T00:00:00Z"},
+		{"2022-01-01", "2021-12-31T16:00:00Z"},
+		{"2022-01-01 08:30", "2022-01-01T00:30:00Z"},
+		{"2022-01-01 08:30:15", "2022-01-01T00:30:15Z"},
+		{"20220101083015", "2022-01-01T00:30:15Z"},
+		{"20220101", "2021-12-31T16:00:00Z"},
+	}
+	for _, tt := range tests {
+		got, err := parseFlagTime(tt.flag)
+		if err != nil || got.UTC().Format(time.RFC3339) != tt.want {
+			t.Errorf("%q is %s, %v, want %s", tt.flag, got.UTC().Format(time.RFC3339), err, tt.want)
+		}
+	}
+	for _, bad := range []string{"yesterday", "2022-13-01", "2022/01/01", "01-01-2022"} {
+		if got, err := parseFlagTime(bad); err == nil {
+			t.Errorf("%q is %s", bad, got)
+		}
+	}
+}
+
+func TestFilterFiles(t *testing.T) {
+	setGlobals(t, "Asia/Hong_Kong")
+	paths := []string{
+		"/in/cdr_a2pgw03a_20211231235959_001",
+		"/in/cdr_a2pgw03a_20220101000000_002.gz",
+		"/in/CDR_smshub05_20220101120000_111",
+		"/in/cdr_a2pgw03a_20220102000000_003",
+		"/in/notes.txt",
+	}
+	tests := []struct {
+		since, until string
+		want         []int
+	}{
+		{"", "", []int{0, 1, 2, 3}},
+		{"2022-01-01", "", []int{1, 2, 3}},
+		{"", "2022-01-02", []int{0, 1, 2}},
+		{"2022-01-01 00:00:01", "2022-01-02", []int{2}},
+		{"2022-01-03", "", nil},
+	}
+	for _, tt := range tests {
+		since, _ = parseFlagTime(tt.since)
+		until, _ = parseFlagTime(tt.until)
+		var want []string
+		for _, i := range tt.want {
+			want = append(want, paths[i])
+		}
+		if got := filterFiles(paths); !reflect.DeepEqual(got, want) {
+			t.Errorf("since %q until %q: %v, want %v", tt.since, tt.until, got, want)
+		}
+	}
+}
+
+func TestMissingFiles(t *testing.T) {
+	setGlobals(t, "UTC")
+	s, err := cdrstore.Open(cdrstore.Options{Backend: "jsonl", File: filepath.Join(t.TempDir(), "log.jsonl")}, cdrstore.Table{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	store = s
+	if err := s.Log(&cdrstore.Record{GwType: 1, FileName: "cdr_a2pgw03a_20220101000000_001"}); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{
+		"/in/cdr_a2pgw03a_20220101000000_001",
+		"/archive/cdr_a2pgw03a_20220101000000_001.gz", // logged by its name without .gz
+		"/in/cdr_a2pgw03a_20220101000000_002",
+		"/archive/cdr_a2pgw03a_20220101000000_002.zst",
+		"/in/cdr_a2pgw03a_20220101000000_003.bz2",
+	}
+	got, err := missingFiles(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := paths[2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("missing %v, want %v", got, want)
+	}
+	if got, err := missingFiles(nil); err != nil || len(got) > 0 {
+		t.Errorf("missing %v, %v of no files", got, err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	alarm "github.com/wadewyuan/smartom-utils-go"
+)
+
+// Duration is a time.Duration read from a string like "30s" or "5m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Monitor watches the stream of files of every gateway while watching. A
+// gateway is identified by its files' names, see Format.Gateway.
+type Monitor struct {
+	// Longest time a gateway may go without a new file, e.g. "15m". The
+	// silence isn't checked when not set.
+	Silence Duration
+
+	// Silence of single gateways by their ID, e.g. {"cdr_a2pgw03a": "30m"}.
+	// These gateways are checked from the start, others once they send a file.
+	Gateways map[string]Duration
+
+	// Longest time the last CDR of a file may be older than the file, e.g.
+	// "30m". The lag isn't checked when not set.
+	MaxLag Duration
+
+	// How often the silence is checked, default 1m
+	CheckInterval Duration
+
+	// Alarm raised when a gateway is silent or lagging
+	AlarmCode string
+
+	// Alarm sent when the gateway recovers, to clear the one raised. Only
+	// the recovery is logged when not set.
+	ClearAlarmCode string
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+// stream is what's known of the files of a gateway
+type stream struct {
+	lastFile   time.Time // arrival of the last file
+	lastRecord time.Time // the latest CDR
+	silent     bool      // whether the silence alarm is raised
+	lagging    bool      // whether the lag alarm is raised
+}
+
+// enabled reports whether anything is checked
+func (m *Monitor) enabled() bool {
+	return m.Silence > 0 || len(m.Gateways) > 0 || m.MaxLag > 0
+}
+
+// start checks the silence of the gateways in the background until the
+// program exits
+func (m *Monitor) start() {
+	m.streams = make(map[string]*stream)
+	now := time.Now()
+	for id := range m.Gateways {
+		m.streams[id] = &stream{lastFile: now}
+	}
+	interval := time.Duration(m.CheckInterval)
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		for t := range time.NewTicker(interval).C {
+			m.check(t)
+		}
+	}()
+}
+
+// silence returns the longest silence of the gateway, zero when unchecked
+func (m *Monitor) silence(id string) time.Duration {
+	if d, ok := m.Gateways[id]; ok {
+		return time.Duration(d)
+	}
+	return time.Duration(m.Silence)
+}
+
+// observe records a file of the gateway which arrived at the time, written at
+// the other, with its latest CDR unless it has none. The silence is timed by
+// the arrival, since a file may keep an old mtime, e.g. copied with rsync -t
+// or read back from a backup, and the lag by the time it was written.
+func (m *Monitor) observe(id string, arrival, written, lastRecord time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.streams[id]
+	if !ok {
+		s = &stream{}
+		m.streams[id] = s
+	}
+	if arrival.After(s.lastFile) {
+		s.lastFile = arrival
+	}
+	if s.silent {
+		s.silent = false
+		m.clear(fmt.Sprintf("CDR stream of %s resumed", id))
+	}
+
+	if lastRecord.After(s.lastRecord) {
+		s.lastRecord = lastRecord
+	}
+	if m.MaxLag <= 0 || lastRecord.IsZero() {
+		return
+	}
+	lag := written.Sub(lastRecord)
+	if lag > time.Duration(m.MaxLag) {
+		if !s.lagging {
+			s.lagging = true
+			m.raise(fmt.Sprintf("CDR stream of %s lags: last CDR at %s, %s before its file arrived", id, lastRecord.Format(time.RFC3339), lag.Round(time.Second)))
+		}
+	} else if s.lagging {
+		s.lagging = false
+		m.clear(fmt.Sprintf("CDR stream of %s caught up, lag %s", id, lag.Round(time.Second)))
+	}
+}
+
+// check raises the alarm for the gateways silent for too long
+func (m *Monitor) check(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []string
+	for id := range m.streams {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		s := m.streams[id]
+		limit := m.silence(id)
+		if limit <= 0 || s.silent {
+			continue
+		}
+		if silent := now.Sub(s.lastFile); silent > limit {
+			s.silent = true
+			msg := fmt.Sprintf("CDR stream of %s is silent: no file for %s, since %s", id, silent.Round(time.Second), s.lastFile.Format(time.RFC3339))
+			if !s.lastRecord.IsZero() {
+				msg += ", last CDR at " + s.lastRecord.Format(time.RFC3339)
+			}
+			m.raise(msg)
+		}
+	}
+}
+
+func (m *Monitor) raise(msg string) {
+	log.Println("ALARM", msg)
+	if len(m.AlarmCode) > 0 {
+		alarm.SendAlarm(m.AlarmCode, msg)
+	}
+}
+
+func (m *Monitor) clear(msg string) {
+	log.Println("CLEAR", msg)
+	if len(m.ClearAlarmCode) > 0 {
+		alarm.SendAlarm(m.ClearAlarmCode, msg)
+	}
+}
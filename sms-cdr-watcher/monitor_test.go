@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	// A step is a file arriving or, without written, a check. The times are
+	// minutes from the start.
+	type step struct {
+		at, written, cdr int
+		file, empty      bool
+	}
+	file := func(at, written, cdr int) step { return step{at: at, written: written, cdr: cdr, file: true} }
+	empty := func(at int) step { return step{at: at, written: at, file: true, empty: true} }
+	check := func(at int) step { return step{at: at} }
+	old := -24 * 60
+
+	tests := []struct {
+		name    string
+		monitor *Monitor
+		steps   []step
+		alarms  []string // ALARM or CLEAR in order
+	}{
+		{
+			name:    "silent then resumed",
+			monitor: &Monitor{Silence: Duration(15 * time.Minute)},
+			steps:   []step{file(0, 0, 0), check(10), check(16), check(17), file(20, 20, 19), check(21), check(34)},
+			alarms:  []string{"ALARM", "CLEAR"},
+		},
+		{
+			// The arrival counts, not the old mtime of a file kept by the copy
+			name:    "resumed with old files",
+			monitor: &Monitor{Silence: Duration(15 * time.Minute)},
+			steps:   []step{file(0, old, old), check(16), file(20, old, old), check(21), check(30), file(31, old, old), check(40)},
+			alarms:  []string{"ALARM", "CLEAR"},
+		},
+		{
+			name:    "unchecked gateway",
+			monitor: &Monitor{Gateways: map[string]Duration{"other": Duration(time.Minute)}},
+			steps:   []step{file(0, 0, 0), check(60)},
+		},
+		{
+			name:    "lagging then caught up",
+			monitor: &Monitor{MaxLag: Duration(30 * time.Minute)},
+			steps:   []step{file(0, 0, -10), file(5, 5, -60), file(10, 10, -50), check(20), file(15, 15, -20), file(20, 20, 0), file(25, 25, 20)},
+			alarms:  []string{"ALARM", "CLEAR"},
+		},
+		{
+			// The lag is timed by the mtime, a file copied late doesn't lag
+			name:    "copied late",
+			monitor: &Monitor{MaxLag: Duration(30 * time.Minute)},
+			steps:   []step{file(120, 0, -10), file(240, 0, -5)},
+		},
+		{
+			name:    "files without CDRs",
+			monitor: &Monitor{MaxLag: Duration(30 * time.Minute)},
+			steps:   []step{empty(0), empty(60)},
+		},
+	}
+	start := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	minute := func(n int) time.Time { return start.Add(time.Duration(n) * time.Minute) }
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		m := tt.monitor
+		m.streams = make(map[string]*stream)
+		for _, s := range tt.steps {
+			if !s.file {
+				m.check(minute(s.at))
+				continue
+			}
+			cdr := minute(s.cdr)
+			if s.empty {
+				cdr = time.Time{}
+			}
+			m.observe("cdr_a2pgw03a", minute(s.at), minute(s.written), cdr)
+		}
+
+		var alarms []string
+		for _, line := range strings.Split(buf.String(), "\n") {
+			for _, kind := range []string{"ALARM", "CLEAR"} {
+				if strings.Contains(line, " "+kind+" ") {
+					alarms = append(alarms, kind)
+				}
+			}
+		}
+		if strings.Join(alarms, ",") != strings.Join(tt.alarms, ",") {
+			t.Errorf("%s: %v, want %v\n%s", tt.name, alarms, tt.alarms, buf.String())
+		}
+	}
+}
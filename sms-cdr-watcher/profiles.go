@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/wadewyuan/go-tools/cdrstore"
+	"github.com/wadewyuan/go-tools/timewindow"
+)
+
+// Profile describes a loading log: the table and the columns its files are
+// logged into, the formats of the files and how their time spans are split
+type Profile struct {
+	Name string
+
+	// Table of the loading log, the values may use the time in the file name
+	// (filetime) and the segment number (segment)
+	Table cdrstore.Table
+
+	// Names of the formats loaded into the table, default all of them
+	Formats []string
+
+	// When set, a row is logged per segment of a file's time span, e.g. per
+	// day; the table then needs the segment in its values and key
+	Segments *timewindow.Options
+
+	splitter *timewindow.Splitter
+}
+
+// defaultProfiles are the built-in profiles, "cdr" is used unless another one
+// is configured. Their tables are created by ddl/oracle.sql, the tables of
+// earlier versions are migrated by ddl/oracle-migrate.sql. A table of
+// another layout is used with a configured profile of the same name, e.g. one
+// without Columns and Key for the positional insert of earlier versions.
+var defaultProfiles = []Profile{
+	{
+		// A file is logged once per gateway type, logging it again updates its row
+		Name: "cdr",
+		Table: cdrstore.Table{
+			Name: "SMS_CDR_LOADING_LOG_EXT",
+			Columns: []string{"ID", "GW_TYPE", "FILE_NAME", "MIN_TIME", "MAX_TIME", "CREATE_TIME", "VERSION",
+				"RECORDS", "BAD_LINES", "HOURS", "FILE_SIZE", "FILE_HASH"},
+			Values: []string{"sms_cdr_loading_log_seq.nextval", "gwtype", "filename", "begin", "end", "SYSDATE", "version",
+				"records", "badlines", "hours", "size", "hash"},
+			Key: []string{"gwtype", "filename"},
+		},
+	},
+	{
+		// The backup of the A2P CDRs, a file is logged once per day segment
+		Name: "a2p-bak",
+		Table: cdrstore.Table{
+			Name:    "SMS_A2P_CDR_LOADING_LOG_EXT",
+			Columns: []string{"FILE_NAME", "FILE_TIME", "MIN_TIME", "MAX_TIME", "SEGMENT", "CREATE_TIME", "VERSION"},
+			Values:  []string{"filename", "filetime", "begin", "end", "segment", "SYSDATE", "version"},
+			Key:     []string{"filename", "segment"},
+		},
+		Formats:  []string{"A2P_BAK"},
+		Segments: &timewindow.Options{Interval: "day"},
+	},
+}
+
+// initProfile returns the profile of the name among the configured and the
+// built-in ones, a configured profile replaces the built-in one of the same
+// name. Its formats are picked from all.
+func initProfile(configured []*Profile, name string, all []*Format) (*Profile, []*Format, error) {
+	if len(name) == 0 {
+		name = "cdr"
+	}
+	var p *Profile
+	for _, c := range configured {
+		if c.Name == name {
+			p = c
+			break
+		}
+	}
+	if p == nil {
+		for i := range defaultProfiles {
+			if defaultProfiles[i].Name == name {
+				d := defaultProfiles[i]
+				p = &d
+				break
+			}
+		}
+	}
+	if p == nil {
+		return nil, nil, fmt.Errorf("unknown profile: %s", name)
+	}
+
+	if p.Segments != nil {
+		var err error
+		if p.splitter, err = timewindow.New(*p.Segments); err != nil {
+			return nil, nil, fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+	}
+
+	if len(p.Formats) == 0 {
+		return p, all, nil
+	}
+	byName := make(map[string]*Format)
+	for _, f := range all {
+		byName[f.Name] = f
+	}
+	var formats []*Format
+	for _, name := range p.Formats {
+		f, ok := byName[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("profile %s: unknown format: %s", p.Name, name)
+		}
+		formats = append(formats, f)
+	}
+	return p, formats, nil
+}
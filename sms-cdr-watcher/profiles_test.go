@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultProfiles(t *testing.T) {
+	for _, p := range defaultProfiles {
+		if len(p.Table.Columns) != len(p.Table.Values) {
+			t.Errorf("%s: %d columns for %d values", p.Name, len(p.Table.Columns), len(p.Table.Values))
+		}
+	}
+
+	p, _, err := initProfile(nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]bool)
+	for _, v := range p.Table.Values {
+		values[v] = true
+	}
+	for _, f := range []string{"gwtype", "filename", "begin", "end", "version", "records", "badlines", "hours", "size", "hash"} {
+		if !values[f] {
+			t.Errorf("%s isn't in the table of the %s profile", f, p.Name)
+		}
+	}
+}
+
+// The profile of the shipped configuration is the built-in one
+func TestConfigProfile(t *testing.T) {
+	b, err := os.ReadFile("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		t.Fatal(err)
+	}
+	configured, _, err := initProfile(c.Profiles, "cdr", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builtin, _, _ := initProfile(nil, "cdr", nil)
+	if !reflect.DeepEqual(configured.Table, builtin.Table) {
+		t.Errorf("table of config.json\n%+v\nbuilt-in\n%+v", configured.Table, builtin.Table)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	alarm "github.com/wadewyuan/smartom-utils-go"
+)
+
+// Quarantine says when a CDR file is invalid and what's done with it. An
+// invalid file isn't logged into the loading log.
+type Quarantine struct {
+	// Bad lines above which a file is invalid, a number like "10" or a
+	// percentage of its lines like "5%". Files are never invalid when empty.
+	MaxBadLines string
+
+	// Directory invalid files are copied to, each with a report of its bad
+	// lines beside it, named after the file with ".report" appended. A file
+	// keeps its path under the watched path holding it, and a number is
+	// added to its name when a file of that name is there already. They're
+	// left where they are when empty.
+	Dir string
+
+	// Move the invalid files rather than copy them
+	Move bool
+
+	// Alarm raised for an invalid file
+	AlarmCode string
+
+	enabled    bool
+	percent    bool
+	maxCount   int
+	maxPercent float64
+
+	mu          sync.Mutex
+	quarantined map[string]*quarantined // path -> its last invalid version
+}
+
+type quarantined struct {
+	hash string
+	err  error
+}
+
+// init parses the threshold
+func (q *Quarantine) init() error {
+	s := strings.TrimSpace(q.MaxBadLines)
+	if len(s) == 0 {
+		return nil
+	}
+	var err error
+	q.enabled = true
+	q.quarantined = make(map[string]*quarantined)
+	if strings.HasSuffix(s, "%") {
+		q.percent = true
+		q.maxPercent, err = strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+		if err == nil && (q.maxPercent < 0 || q.maxPercent > 100) {
+			err = errors.New("out of range")
+		}
+	} else {
+		q.maxCount, err = strconv.Atoi(s)
+		if err == nil && q.maxCount < 0 {
+			err = errors.New("negative")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid maxbadlines %s: %w", q.MaxBadLines, err)
+	}
+	return nil
+}
+
+// invalid returns why the file of the statistics is invalid, or an empty
+// string when it isn't
+func (q *Quarantine) invalid(stats *fileStats) string {
+	if !q.enabled || stats.BadLines == 0 {
+		return ""
+	}
+	lines := stats.Records + stats.BadLines
+	if q.percent {
+		percent := float64(stats.BadLines) * 100 / float64(lines)
+		if percent <= q.maxPercent {
+			return ""
+		}
+		return fmt.Sprintf("%d bad lines of %d (%.1f%%), more than %s", stats.BadLines, lines, percent, q.MaxBadLines)
+	}
+	if stats.BadLines <= q.maxCount {
+		return ""
+	}
+	return fmt.Sprintf("%d bad lines of %d, more than %d", stats.BadLines, lines, q.maxCount)
+}
+
+// checkFile quarantines the file when it's invalid, raises the alarm and
+// returns an error with the reason. A version of the file quarantined already
+// only gets the error.
+func checkFile(path string, stats *fileStats) error {
+	q := &conf.Quarantine
+	reason := q.invalid(stats)
+	if len(reason) == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if prev := q.quarantined[path]; prev != nil && prev.hash == stats.Hash {
+		return prev.err
+	}
+	if len(q.Dir) > 0 {
+		dest, err := q.put(path, reason, stats)
+		if err != nil {
+			log.Println("ERROR", err)
+		} else {
+			reason += ", quarantined to " + dest
+		}
+	}
+	if len(q.AlarmCode) > 0 {
+		alarm.SendAlarm(q.AlarmCode, fmt.Sprintf("Invalid CDR file: %s, %s", path, reason))
+	}
+	err := errors.New("invalid file, " + reason)
+	q.quarantined[path] = &quarantined{hash: stats.Hash, err: err}
+	return err
+}
+
+// moved returns the error of the file when it was moved to quarantine and
+// nothing was written at its path since
+func (q *Quarantine) moved(path string) error {
+	if !q.Move {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	prev := q.quarantined[path]
+	if prev == nil {
+		return nil
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return nil
+	}
+	return prev.err
+}
+
+// put copies or moves the file into the quarantine directory and writes its
+// report, it returns the new path of the file
+func (q *Quarantine) put(path, reason string, stats *fileStats) (string, error) {
+	dest := unusedName(filepath.Join(q.Dir, watchedPath(path)))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	if err := writeReport(dest+".report", path, reason, stats); err != nil {
+		return "", err
+	}
+
+	if q.Move {
+		// Rename doesn't work across file systems, copy then
+		if err := os.Rename(path, dest); err == nil {
+			return dest, nil
+		}
+	}
+	if err := copyFile(path, dest); err != nil {
+		return "", err
+	}
+	if q.Move {
+		if err := os.Remove(path); err != nil {
+			return "", err
+		}
+	}
+	return dest, nil
+}
+
+// watchedPath returns the path of the file under the watched path holding it,
+// its name when there's none
+func watchedPath(path string) string {
+	for _, root := range conf.Paths {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != "." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return rel
+		}
+	}
+	return filepath.Base(path)
+}
+
+// unusedName returns the name, or the name with a number before its
+// extension, e.g. "a.1.DAT", when there's a file or a report with it
+func unusedName(name string) string {
+	ext := filepath.Ext(name)
+	trimmed := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		_, err := os.Lstat(name)
+		_, reportErr := os.Lstat(name + ".report")
+		if os.IsNotExist(err) && os.IsNotExist(reportErr) {
+			return name
+		}
+		name = fmt.Sprintf("%s.%d%s", trimmed, i, ext)
+	}
+}
+
+// writeReport lists the bad lines of the file with the reasons
+func writeReport(name, path, reason string, stats *fileStats) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "File: %s\n", path)
+	fmt.Fprintf(w, "Invalid: %s\n", reason)
+	fmt.Fprintf(w, "Records: %d, Bad lines: %d\n\n", stats.Records, stats.BadLines)
+	for _, b := range stats.Bad {
+		fmt.Fprintf(w, "line %d: %s\n", b.Line, b.Reason)
+	}
+	if more := stats.BadLines - len(stats.Bad); more > 0 {
+		fmt.Fprintf(w, "... %d more\n", more)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		max               string
+		records, badLines int
+		invalid           bool
+	}{
+		{"", 0, 10, false},
+		{"10", 100, 10, false},
+		{"10", 100, 11, true},
+		{"0", 100, 1, true},
+		{"5%", 95, 5, false},
+		{"5%", 94, 6, true},
+		{"5%", 0, 0, false},
+	}
+	for _, tt := range tests {
+		q := &Quarantine{MaxBadLines: tt.max}
+		if err := q.init(); err != nil {
+			t.Fatal(err)
+		}
+		reason := q.invalid(&fileStats{Records: tt.records, BadLines: tt.badLines})
+		if (len(reason) > 0) != tt.invalid {
+			t.Errorf("%s with %d bad lines of %d: %q", tt.max, tt.badLines, tt.records+tt.badLines, reason)
+		}
+	}
+
+	for _, max := range []string{"x", "-1", "101%"} {
+		q := &Quarantine{MaxBadLines: max}
+		if err := q.init(); err == nil {
+			t.Errorf("maxbadlines %s is valid", max)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	root, dir := t.TempDir(), t.TempDir()
+	conf = &Config{Paths: []string{root}, Quarantine: Quarantine{MaxBadLines: "1", Dir: dir, Move: true}}
+	if err := conf.Quarantine.init(); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) string {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	bad := func(hash string) *fileStats {
+		return &fileStats{Records: 1, BadLines: 2, Bad: []badLine{{2, "no delivery time"}}, Hash: hash}
+	}
+
+	a := write("a/x.DAT", "1")
+	b := write("b/x.DAT", "2")
+	errA := checkFile(a, bad("1"))
+	if errA == nil {
+		t.Fatal("invalid file passed")
+	}
+	if err := checkFile(b, bad("2")); err == nil {
+		t.Fatal("invalid file passed")
+	}
+
+	// Another event of the moved file
+	if err := checkFile(a, bad("1")); err != errA {
+		t.Errorf("quarantined again: %v", err)
+	}
+	if err := conf.Quarantine.moved(a); err != errA {
+		t.Errorf("moved = %v, want %v", err, errA)
+	}
+
+	// A new version of the file
+	a = write("a/x.DAT", "3")
+	if err := conf.Quarantine.moved(a); err != nil {
+		t.Errorf("moved = %v for a new file", err)
+	}
+	if err := checkFile(a, bad("3")); err == nil || err == errA {
+		t.Errorf("new version: %v", err)
+	}
+
+	var files []string
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	want := []string{"a/x.1.DAT", "a/x.1.DAT.report", "a/x.DAT", "a/x.DAT.report", "b/x.DAT", "b/x.DAT.report"}
+	if strings.Join(files, " ") != strings.Join(want, " ") {
+		t.Errorf("quarantine has %v, want %v", files, want)
+	}
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Error("file not moved")
+	}
+}
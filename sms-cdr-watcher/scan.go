@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wadewyuan/go-tools/decompress"
+)
+
+// How often the progress of a scan is logged
+var progressInterval = 10 * time.Second
+
+type scanResult struct {
+	path   string
+	format *Format
+	stats  *fileStats
+	err    error
+}
+
+// scanPaths loads the CDR files under the paths which aren't logged yet. The
+// trees are walked once, a pool of workers reads the files and a single
+// goroutine writes the results to the loading log. A signal on stop ends the
+// scan once the files being read are done, the files done so far are kept in
+// the checkpoint file and skipped by the next scan.
+func scanPaths(paths []string, workers int, checkpoint string, stop <-chan os.Signal) error {
+	done, err := readCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+	if len(done) > 0 {
+		log.Printf("Resuming from %s, %d files done already\n", checkpoint, len(done))
+	}
+
+	var files []string
+	for _, p := range paths {
+		log.Printf("Scanning %s\n", p)
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Println("ERROR", err)
+				return nil
+			}
+			if !info.IsDir() && !done[path] {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("ERROR", err)
+		}
+	}
+	files, err = missingFiles(filterFiles(files))
+	if err != nil {
+		return err
+	}
+	log.Printf("%d files to load\n", len(files))
+
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan string)
+	results := make(chan scanResult, workers)
+	var readers sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for path := range jobs {
+				r := scanResult{path: path, format: findFormat(formats, path)}
+				r.stats, r.err = readStats(path, r.format)
+				if r.err == nil {
+					r.err = checkFile(path, r.stats)
+				}
+				results <- r
+			}
+		}()
+	}
+
+	p := &progress{total: len(files), start: time.Now()}
+	writer := make(chan struct{})
+	go func() {
+		defer close(writer)
+		for r := range results {
+			if r.err == nil && r.stats.Records > 0 { // Skip empty files
+				r.err = logFileNameAndTimes(r.format, decompress.TrimExt(filepath.Base(r.path)), r.stats)
+			}
+			if r.err != nil {
+				log.Printf("Error processing file: %s, %s\n", r.path, r.err)
+			} else {
+				done[r.path] = true
+			}
+			p.add()
+		}
+	}()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	interrupted := false
+	for i := 0; i < len(files) && !interrupted; {
+		select {
+		case jobs <- files[i]:
+			i++
+		case <-ticker.C:
+			p.report()
+		case <-stop:
+			log.Println("Interrupted, finishing the files being read")
+			interrupted = true
+		}
+	}
+	close(jobs)
+	readers.Wait()
+	close(results)
+	<-writer
+	p.report()
+
+	if !interrupted {
+		os.Remove(checkpoint)
+		return nil
+	}
+	if err := writeCheckpoint(checkpoint, done); err != nil {
+		return err
+	}
+	log.Printf("Checkpoint written to %s, run the scan again to resume\n", checkpoint)
+	return nil
+}
+
+type progress struct {
+	total int
+	done  int64
+	start time.Time
+}
+
+func (p *progress) add() {
+	atomic.AddInt64(&p.done, 1)
+}
+
+func (p *progress) report() {
+	done := atomic.LoadInt64(&p.done)
+	elapsed := time.Since(p.start)
+	rate := float64(done) / elapsed.Seconds()
+	eta := "unknown"
+	if rate > 0 {
+		remaining := float64(int64(p.total)-done) / rate
+		eta = time.Duration(remaining * float64(time.Second)).Round(time.Second).String()
+	}
+	log.Printf("Scanned %d/%d files, %.1f files/s, ETA %s\n", done, p.total, rate, eta)
+}
+
+// readCheckpoint returns the files done by an interrupted scan
+func readCheckpoint(name string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		done[scanner.Text()] = true
+	}
+	return done, scanner.Err()
+}
+
+func writeCheckpoint(name string, done map[string]bool) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for path := range done {
+		w.WriteString(path + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
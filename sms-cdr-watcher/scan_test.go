@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/wadewyuan/go-tools/cdrstore"
+)
+
+// recordingStore keeps the names of the files logged, and interrupts the scan
+// once it has as many as stopAfter
+type recordingStore struct {
+	mu        sync.Mutex
+	names     []string
+	stopAfter int
+	stop      chan os.Signal
+}
+
+func (s *recordingStore) Log(records ...*cdrstore.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range records {
+		s.names = append(s.names, r.FileName)
+	}
+	if len(s.names) == s.stopAfter {
+		s.stop <- os.Interrupt
+	}
+	return nil
+}
+
+func (s *recordingStore) Missing(names []string) ([]string, error) {
+	return names, nil
+}
+
+func (s *recordingStore) Close() error {
+	return nil
+}
+
+func TestScanResume(t *testing.T) {
+	setGlobals(t, "UTC")
+	defer func(c *Config, p *Profile) { conf, profile = c, p }(conf, profile)
+	conf = &Config{}
+	if err := conf.Quarantine.init(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if profile, _, err = initProfile(nil, "cdr", formats); err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	var want []string
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("cdr_a2pgw0%da_20220101%06d_%03d", i%4, i, i)
+		dir := filepath.Join(root, fmt.Sprint(i%3))
+		os.MkdirAll(dir, 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("a|20220101000000|x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("x"), 0644)
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+
+	stop := make(chan os.Signal, 1)
+	first := &recordingStore{stopAfter: 50, stop: stop}
+	store = first
+	if err := scanPaths([]string{root}, 4, checkpoint, stop); err != nil {
+		t.Fatal(err)
+	}
+	if len(first.names) < 50 || len(first.names) == len(want) {
+		t.Fatalf("%d files logged before the interruption", len(first.names))
+	}
+	done, err := readCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(first.names) {
+		t.Errorf("%d files in the checkpoint, %d logged", len(done), len(first.names))
+	}
+
+	// The store doesn't know the files, the checkpoint alone skips them
+	second := &recordingStore{stop: stop}
+	store = second
+	if err := scanPaths([]string{root}, 4, checkpoint, stop); err != nil {
+		t.Fatal(err)
+	}
+	got := append(append([]string{}, first.names...), second.names...)
+	sort.Strings(got)
+	for i := 1; i < len(got); i++ {
+		if got[i] == got[i-1] {
+			t.Errorf("%s logged twice", got[i])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("%d files logged, want %d", len(got), len(want))
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Error("checkpoint kept after a complete scan")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wadewyuan/go-tools/decompress"
+)
+
+// fileStats are the figures of a CDR file, collected in a single pass
+type fileStats struct {
+	Begin    time.Time
+	End      time.Time
+	Records  int
+	BadLines int
+	Bad      []badLine      // the first maxBadReported bad lines
+	Hours    map[string]int // yyyyMMddHH in the business time zone -> records
+	Size     int64
+	Hash     string // SHA-256 of the content
+}
+
+// A line without a delivery time, numbered from 1
+type badLine struct {
+	Line   int
+	Reason string
+}
+
+// How many bad lines of a file are kept for its report
+var maxBadReported = 1000
+
+// Lines longer than this are bad lines
+var maxLineLength = 1024 * 1024
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// readStats reads the CDR file and collects its figures
+func readStats(path string, format *Format) (*fileStats, error) {
+	f, err := decompress.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The figures are of the decompressed content, so an archived file
+	// matches the original
+	hash := sha256.New()
+	size := &countingWriter{}
+	r := bufio.NewReaderSize(io.TeeReader(f, io.MultiWriter(hash, size)), 64*1024)
+
+	stats := &fileStats{Hours: make(map[string]int)}
+	n := 0
+	var buf []byte
+	for {
+		b, long, err := readLine(r, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		buf = b
+		n++
+		var t time.Time
+		if long {
+			err = fmt.Errorf("longer than %d bytes", maxLineLength)
+		} else {
+			line := string(b)
+			if len(strings.TrimSpace(line)) == 0 {
+				continue
+			}
+			t, err = format.deliveryTime(line)
+		}
+		if err != nil {
+			stats.BadLines++
+			if len(stats.Bad) < maxBadReported {
+				stats.Bad = append(stats.Bad, badLine{Line: n, Reason: err.Error()})
+			}
+			continue
+		}
+		stats.Records++
+		stats.Hours[t.In(business).Format("2006010215")]++
+		if stats.End.IsZero() || t.After(stats.End) {
+			stats.End = t
+		}
+		if stats.Begin.IsZero() || t.Before(stats.Begin) {
+			stats.Begin = t
+		}
+	}
+
+	stats.Size = size.n
+	stats.Hash = hex.EncodeToString(hash.Sum(nil))
+	return stats, nil
+}
+
+// readLine reads the next line into buf without its end of line. A line
+// longer than maxLineLength is read to its end but not kept, long is set.
+func readLine(r *bufio.Reader, buf []byte) (line []byte, long bool, err error) {
+	line = buf[:0]
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !long {
+			line = append(line, chunk...)
+			// With room for the end of line
+			if len(line) > maxLineLength+2 {
+				long, line = true, line[:0]
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		// The last line may have no end, EOF comes with the next call then
+		if err != nil && (err != io.EOF || len(line) == 0 && !long) {
+			return nil, false, err
+		}
+		break
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if long || len(line) > maxLineLength {
+		return line[:0], true, nil
+	}
+	return line, false, nil
+}
+
+// hours formats the counts per hour as "yyyyMMddHH:n" in time order
+func (s *fileStats) hours() string {
+	var hours []string
+	for h := range s.Hours {
+		hours = append(hours, h)
+	}
+	sort.Strings(hours)
+	for i, h := range hours {
+		hours[i] = h + ":" + strconv.Itoa(s.Hours[h])
+	}
+	return strings.Join(hours, " ")
+}
+
+// printReport writes the figures of every CDR file under dir as a table, or
+// as CSV. Files with the same content as an earlier one are marked.
+func printReport(w io.Writer, dir string, asCSV bool) error {
+	header := []string{"FILE", "FORMAT", "SIZE", "RECORDS", "BAD", "BEGIN", "END", "HASH", "SAME_AS", "HOURS"}
+	var write func([]string)
+	var flush func() error
+	if asCSV {
+		cw := csv.NewWriter(w)
+		write = func(row []string) { cw.Write(row) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		write = func(row []string) { fmt.Fprintln(tw, strings.Join(row, "\t")) }
+		flush = tw.Flush
+	}
+
+	write(header)
+	seen := make(map[string]string) // hash -> first file
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		format := findFormat(formats, path)
+		if format == nil {
+			return nil
+		}
+		stats, err := readStats(path, format)
+		if err != nil {
+			return err
+		}
+
+		sameAs := seen[stats.Hash]
+		if len(sameAs) == 0 {
+			seen[stats.Hash] = path
+		}
+		var begin, end string
+		if stats.Records > 0 {
+			begin = stats.Begin.Format(time.RFC3339)
+			end = stats.End.Format(time.RFC3339)
+		}
+		write([]string{path, format.Name, strconv.FormatInt(stats.Size, 10), strconv.Itoa(stats.Records), strconv.Itoa(stats.BadLines), begin, end, stats.Hash, sameAs, stats.hours()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	defer func(n int) { maxLineLength = n }(maxLineLength)
+	maxLineLength = 10
+
+	in := "short\n0123456789\n0123456789x\r\n0123456789\r\n\n" + strings.Repeat("y", 100) + "\nlast"
+	want := []string{"short", "0123456789", "", "0123456789", "", "", "last"}
+	long := []bool{false, false, true, false, false, true, false}
+	// A small buffer makes the long lines span several reads
+	r := bufio.NewReaderSize(strings.NewReader(in), 16)
+	var buf []byte
+	for i := range want {
+		line, l, err := readLine(r, buf)
+		if err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+		if string(line) != want[i] || l != long[i] {
+			t.Errorf("line %d is %q, long %t, want %q, %t", i+1, line, l, want[i], long[i])
+		}
+		buf = line
+	}
+	if _, _, err := readLine(r, buf); err != io.EOF {
+		t.Errorf("after the last line: %v", err)
+	}
+}
+
+// A line too long is a bad line, the rest of the file is read
+func TestReadStatsLongLine(t *testing.T) {
+	setGlobals(t, "UTC")
+	defer func(n int) { maxLineLength = n }(maxLineLength)
+	maxLineLength = 100 * 1024
+
+	f := formatNamed(formats, "A2PGW")
+	name := filepath.Join(t.TempDir(), "cdr_a2pgw03a_20240701000000_001")
+	content := "a|20240701000000|x\n" + strings.Repeat("a|", 100*1024) + "\na|20240701003000|x\n"
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := readStats(name, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Records != 2 || stats.BadLines != 1 || stats.Size != int64(len(content)) {
+		t.Errorf("%d records, %d bad lines, %d bytes", stats.Records, stats.BadLines, stats.Size)
+	}
+	if len(stats.Bad) != 1 || stats.Bad[0].Line != 2 || !strings.HasPrefix(stats.Bad[0].Reason, "longer than") {
+		t.Errorf("bad lines %+v", stats.Bad)
+	}
+}
+
+func TestPrintReport(t *testing.T) {
+	setGlobals(t, "UTC")
+	dir := t.TempDir()
+	files := map[string]string{
+		"a/cdr_a2pgw03a_20240701000000_001": "a|20240701000000|x\na|20240701013000|x\nbad\n",
+		"b/cdr_a2pgw03a_20240701000000_002": "a|20240701000000|x\na|20240701013000|x\nbad\n",
+		"b/cdr_a2pgw03b_20240701000000_003": "\n",
+		"b/notes.txt":                       "x\n",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := printReport(&out, dir, true); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || strings.Join(rows[0], ",") != "FILE,FORMAT,SIZE,RECORDS,BAD,BEGIN,END,HASH,SAME_AS,HOURS" {
+		t.Fatalf("report\n%v", rows)
+	}
+	a, b, empty := rows[1], rows[2], rows[3]
+	want := []string{filepath.Join(dir, "a/cdr_a2pgw03a_20240701000000_001"), "A2PGW", "42", "2", "1", "2024-07-01T00:00:00Z", "2024-07-01T01:30:00Z"}
+	if strings.Join(a[:7], ",") != strings.Join(want, ",") || len(a[8]) > 0 || a[9] != "2024070100:1 2024070101:1" {
+		t.Errorf("row %v", a)
+	}
+	if b[7] != a[7] || b[8] != a[0] {
+		t.Errorf("same content isn't marked: %v", b)
+	}
+	if empty[3] != "0" || len(empty[5]) > 0 || len(empty[6]) > 0 {
+		t.Errorf("row of an empty file %v", empty)
+	}
+
+	out.Reset()
+	if err := printReport(&out, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "FILE ") || !strings.Contains(lines[2], a[0]) {
+		t.Errorf("table\n%s", out.String())
+	}
+}
@@ -8,11 +8,14 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/sftp"
+	"github.com/wadewyuan/go-tools/fswatch"
 	SSHTunnel "github.com/wadewyuan/go-tools/ssh"
+	"github.com/wadewyuan/go-tools/stability"
 	alarm "github.com/wadewyuan/smartom-utils-go"
 	"golang.org/x/crypto/ssh"
 )
@@ -36,36 +39,38 @@ type Config struct {
 	Tunnel Endpoint
 
 	AlarmCode string
-}
-
-var watcher *fsnotify.Watcher
-
-// watchDir gets run as a walk func, searching for directories to add watchers to
-func watchDir(path string, fi os.FileInfo, err error) error {
 
-	// since fsnotify can watch all the files in a directory, watchers only need
-	// to be added to each nested directory
-	if fi.Mode().IsDir() {
-		return watcher.Add(path)
-	}
+	// Checks to make sure a file is completely written before syncing it
+	Stability stability.Options
 
-	return nil
+	// Filters and polling of the file watcher
+	Watch fswatch.Options
 }
 
-func indexOf(element string, data []string) int {
-	for k, v := range data {
-		if element == v {
-			return k
+var watcher *fswatch.Watcher
+
+// getRemoteDir maps the local directory of a file to the remote path to upload it to,
+// sub directories below the configured local path are kept
+func getRemoteDir(dir string, conf Config) (string, error) {
+	dir = filepath.Clean(dir)
+	for i, p := range conf.LocalPaths {
+		rel, err := filepath.Rel(filepath.Clean(p), dir)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
 		}
+		return filepath.Join(conf.RemotePaths[i], rel), nil
 	}
-	return -1 //not found.
+	return "", fmt.Errorf("no remote path for directory: %s", dir)
 }
 
 func syncFile(path string, tunnel *SSHTunnel.SSHTunnel, conf Config) error {
 
-	// Get the index of the file directory in conf.LocalPaths, then get the corresponding remote path to upload file to
+	// Get the corresponding remote path of the file directory to upload file to
 	dir, fname := filepath.Split(path)
-	remoteDir := conf.RemotePaths[indexOf(dir, conf.LocalPaths)]
+	remoteDir, err := getRemoteDir(dir, conf)
+	if err != nil {
+		return err
+	}
 
 	// Open local file and copy it to /tmp to avoic conflicts
 	srcFile, err := os.Open(path)
@@ -123,6 +128,12 @@ func syncFile(path string, tunnel *SSHTunnel.SSHTunnel, conf Config) error {
 	// Close connection
 	defer client.Close()
 
+	// The sub directory may be new
+	if err := client.MkdirAll(remoteDir); err != nil {
+		log.Print(err)
+		return err
+	}
+
 	// Add a ".writing" prefix during the uploading process
 	dstFile, err := client.Create(remoteDir + "/.writing" + fname)
 	if err != nil {
@@ -202,59 +213,55 @@ func main() {
 	// some libraries.
 
 	// creates a new file watcher
-	watcher, _ = fsnotify.NewWatcher()
+	watcher, err = fswatch.NewWatcher(conf.Watch)
+	if err != nil {
+		log.Fatal("can't create file watcher: ", err)
+	}
 	defer watcher.Close()
 
 	// starting at the root of the project, walk each file/directory searching for
 	// directories
 	for _, p := range conf.LocalPaths {
 
-		if err := filepath.Walk(p, watchDir); err != nil {
+		if err := watcher.AddTree(p); err != nil {
 			log.Println("ERROR", err)
 		} else {
 			log.Printf("Watching %s\n", p)
 		}
 	}
 
-	//
-	done := make(chan bool)
-
-	//
-	go func() {
-		for {
-			select {
-			// watch for events
-			case event := <-watcher.Events:
-				log.Printf("EVENT: %s, OP: %s\n", event.Name, event.Op.String())
-
-				var op = fsnotify.Create
-				if len(conf.LocalEvent) > 0 {
-					switch conf.LocalEvent {
-					case "CLOSEWRITE":
-						op = fsnotify.CloseWrite
-					case "CREATE":
-						op = fsnotify.Create
-					default:
-						op = fsnotify.Create
-					}
-				}
+	checker := stability.NewChecker(conf.Stability)
+
+	var op = fsnotify.Create
+	if len(conf.LocalEvent) > 0 {
+		switch conf.LocalEvent {
+		case "CLOSEWRITE":
+			op = fsnotify.CloseWrite
+		case "CREATE":
+			op = fsnotify.Create
+		default:
+			op = fsnotify.Create
+		}
+	}
+
+	watcher.Run(func(event fswatch.Event) {
+		log.Printf("EVENT: %s, OP: %s\n", event.Name, event.Op.String())
+		checker.Observe(event.Event)
 
-				if event.Op == op {
-					err := syncFile(event.Name, tunnel, conf)
-					if err != nil {
-						var msg = fmt.Sprintf("Error sync file: %s ", event.Name)
-						log.Println(msg, err)
-						if len(conf.AlarmCode) > 0 {
-							alarm.SendAlarm(conf.AlarmCode, msg)
-						}
+		if event.Op&op != 0 {
+			path := event.Name
+			checker.Handle(path, func(err error) {
+				if err == nil {
+					err = syncFile(path, tunnel, conf)
+				}
+				if err != nil {
+					var msg = fmt.Sprintf("Error sync file: %s ", path)
+					log.Println(msg, err)
+					if len(conf.AlarmCode) > 0 {
+						alarm.SendAlarm(conf.AlarmCode, msg)
 					}
 				}
-				// watch for errors
-			case err := <-watcher.Errors:
-				log.Println("ERROR", err)
-			}
+			})
 		}
-	}()
-
-	<-done
+	})
 }
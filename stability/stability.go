@@ -0,0 +1,292 @@
+// Package stability decides when a file that is being watched has been
+// completely written and is safe to process.
+package stability
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	ErrIgnored = errors.New("stability: temporary file ignored")
+	ErrTimeout = errors.New("stability: file did not become stable in time")
+	ErrClosed  = errors.New("stability: checker closed")
+)
+
+// How often the file is checked while waiting
+var PollInterval = time.Second
+
+// Options are the stability checks a watcher can opt into, a zero value
+// treats every file as complete
+type Options struct {
+	// Wait until size and mtime are unchanged for this many seconds
+	StableSeconds int
+
+	// Wait for a companion marker file, e.g. ".CNT" or ".done". Both
+	// "name.DAT.CNT" and "name.CNT" are accepted for "name.DAT"
+	Markers []string
+
+	// Files with these name prefixes or suffixes are still being written and are ignored, e.g. ".writing", ".tmp"
+	IgnorePrefixes []string
+	IgnoreSuffixes []string
+
+	// Treat a file renamed into its directory as complete, e.g. "x.tmp" renamed
+	// to "x". Without the other checks, a file written in place is complete
+	// once it's closed after writing.
+	RenameCompletes bool
+
+	// Give up waiting after this many seconds, default 3600
+	TimeoutSeconds int
+}
+
+// Enabled reports whether any of the waiting checks is configured
+func (o *Options) Enabled() bool {
+	return o.StableSeconds > 0 || len(o.Markers) > 0 || o.RenameCompletes
+}
+
+// Ignored reports whether the file is a temporary file by its name
+func (o *Options) Ignored(path string) bool {
+	name := filepath.Base(path)
+	for _, p := range o.IgnorePrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	for _, s := range o.IgnoreSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	for _, m := range o.Markers {
+		if strings.HasSuffix(name, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMarker reports whether one of the marker files of path exists
+func (o *Options) hasMarker(path string) bool {
+	if len(o.Markers) == 0 {
+		return true
+	}
+	trimmed := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, m := range o.Markers {
+		if _, err := os.Stat(path + m); err == nil {
+			return true
+		}
+		if _, err := os.Stat(trimmed + m); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// renameWindow is how close a Create must follow a Rename in the same
+// directory to be taken as the new name of the renamed file
+const renameWindow = time.Second
+
+// writeWindow is how long a close after writing is kept for a wait to see it
+const writeWindow = time.Minute
+
+// Checker applies the Options to the events of a watcher
+type Checker struct {
+	Options
+
+	mu      sync.Mutex
+	moves   map[string]time.Time // directory -> time of a Rename whose new name isn't known yet
+	renames map[string]time.Time // path -> time it was renamed into its directory
+	writes  map[string]time.Time // path -> time it was closed after writing
+	waiting map[string]bool      // paths being waited for
+	closed  bool
+	stop    chan struct{}
+	pending sync.WaitGroup
+}
+
+func NewChecker(o Options) *Checker {
+	if o.TimeoutSeconds <= 0 {
+		o.TimeoutSeconds = 3600
+	}
+	return &Checker{
+		Options: o,
+		moves:   make(map[string]time.Time),
+		renames: make(map[string]time.Time),
+		writes:  make(map[string]time.Time),
+		waiting: make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Close stops the waits, which fail with ErrClosed, and returns once the
+// functions given to Handle have returned. Files handled after are skipped.
+func (c *Checker) Close() {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.stop)
+	}
+	c.mu.Unlock()
+	c.pending.Wait()
+}
+
+// Observe has to be called with every event of the watcher, so renames can be
+// detected. fsnotify reports the new name of a renamed file as Create, right
+// after the Rename of the old name in the same directory. With RenameCompletes
+// the closes after writing are tracked too, they complete the other files.
+func (c *Checker) Observe(event fsnotify.Event) {
+	if !c.RenameCompletes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for dir, t := range c.moves {
+		if now.Sub(t) > renameWindow {
+			delete(c.moves, dir)
+		}
+	}
+	for path, t := range c.renames {
+		if now.Sub(t) > renameWindow {
+			delete(c.renames, path)
+		}
+	}
+	for path, t := range c.writes {
+		if now.Sub(t) > writeWindow {
+			delete(c.writes, path)
+		}
+	}
+
+	switch {
+	case event.Op&fsnotify.CloseWrite != 0:
+		c.writes[event.Name] = now
+	case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+		// Being written again
+		delete(c.writes, event.Name)
+	}
+
+	dir := filepath.Dir(event.Name)
+	switch {
+	case event.Op&fsnotify.Rename != 0:
+		c.moves[dir] = now
+	case event.Op&fsnotify.Create != 0:
+		if _, ok := c.moves[dir]; ok {
+			delete(c.moves, dir)
+			c.renames[event.Name] = now
+		}
+	default:
+		// Another event in between, the Rename was a move out of the directory
+		delete(c.moves, dir)
+	}
+}
+
+// Renamed reports whether the file was just renamed into its directory, only
+// when RenameCompletes is set
+func (c *Checker) Renamed(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.renames[path]
+	return ok && time.Since(t) <= renameWindow
+}
+
+// written reports whether the file was closed after writing since it was
+// last created or written to
+func (c *Checker) written(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.writes[path]
+	return ok
+}
+
+// Wait blocks until the file is complete according to the options. It returns
+// ErrIgnored for temporary files and ErrTimeout when the file keeps changing.
+func (c *Checker) Wait(path string) error {
+	if c.Ignored(path) {
+		return ErrIgnored
+	}
+	if c.RenameCompletes && c.Renamed(path) {
+		return nil
+	}
+
+	deadline := time.Now().Add(time.Duration(c.TimeoutSeconds) * time.Second)
+	stable := time.Duration(c.StableSeconds) * time.Second
+	var (
+		last  os.FileInfo
+		since time.Time
+	)
+	for {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		ready := c.hasMarker(path)
+		if c.RenameCompletes && stable == 0 && len(c.Markers) == 0 {
+			ready = c.written(path)
+		}
+		if stable > 0 {
+			if last == nil || fi.Size() != last.Size() || !fi.ModTime().Equal(last.ModTime()) {
+				last = fi
+				since = time.Now()
+				ready = false
+			} else if time.Since(since) < stable {
+				ready = false
+			}
+		}
+		if ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		select {
+		case <-time.After(PollInterval):
+		case <-c.stop:
+			return ErrClosed
+		}
+	}
+}
+
+// Handle calls fn once the file is complete, with the error if waiting failed.
+// When there's something to wait for fn is called from a new goroutine so the
+// caller's event loop isn't blocked, and the events of a file while it's
+// waited for are merged into that wait. It reports whether fn will be called:
+// temporary files, files already waited for and files handled after Close are
+// skipped.
+func (c *Checker) Handle(path string, fn func(err error)) bool {
+	if c.Ignored(path) {
+		return false
+	}
+	c.mu.Lock()
+	if c.closed || c.waiting[path] {
+		c.mu.Unlock()
+		return false
+	}
+	c.pending.Add(1)
+	wait := c.Enabled()
+	if wait {
+		c.waiting[path] = true
+	}
+	c.mu.Unlock()
+
+	if !wait {
+		defer c.pending.Done()
+		fn(nil)
+		return true
+	}
+	go func() {
+		defer c.pending.Done()
+		err := c.Wait(path)
+		// Events from now on may be a new version of the file
+		c.mu.Lock()
+		delete(c.waiting, path)
+		delete(c.writes, path)
+		c.mu.Unlock()
+		fn(err)
+	}()
+	return true
+}
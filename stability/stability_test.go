@@ -0,0 +1,240 @@
+package stability
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func init() {
+	PollInterval = 10 * time.Millisecond
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	o := Options{IgnorePrefixes: []string{".writing"}, IgnoreSuffixes: []string{".tmp"}, Markers: []string{".done"}}
+	for path, want := range map[string]bool{
+		"/d/a.DAT":          false,
+		"/d/a.DAT.tmp":      true,
+		"/d/.writing.a.DAT": true,
+		"/d/a.DAT.done":     true,
+		"/d.tmp/a.DAT":      false,
+	} {
+		if got := o.Ignored(path); got != want {
+			t.Errorf("Ignored(%s) = %t, want %t", path, got, want)
+		}
+	}
+}
+
+func TestRenamed(t *testing.T) {
+	c := NewChecker(Options{RenameCompletes: true})
+	c.Observe(fsnotify.Event{Name: "/d/a.tmp", Op: fsnotify.Rename})
+	c.Observe(fsnotify.Event{Name: "/d/a", Op: fsnotify.Create})
+	c.Observe(fsnotify.Event{Name: "/d/b", Op: fsnotify.Create})
+	if !c.Renamed("/d/a") {
+		t.Error("the new name of the renamed file isn't renamed")
+	}
+	if c.Renamed("/d/b") {
+		t.Error("a file created in the same directory is renamed")
+	}
+
+	// A file moved out of the directory, then one written
+	c.Observe(fsnotify.Event{Name: "/d/c", Op: fsnotify.Rename})
+	c.Observe(fsnotify.Event{Name: "/d/e", Op: fsnotify.Write})
+	c.Observe(fsnotify.Event{Name: "/d/f", Op: fsnotify.Create})
+	if c.Renamed("/d/f") {
+		t.Error("a Create after other events is renamed")
+	}
+
+	c = NewChecker(Options{})
+	c.Observe(fsnotify.Event{Name: "/d/a.tmp", Op: fsnotify.Rename})
+	c.Observe(fsnotify.Event{Name: "/d/a", Op: fsnotify.Create})
+	if c.Renamed("/d/a") {
+		t.Error("renamed without RenameCompletes")
+	}
+}
+
+func TestWaitStable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a")
+	writeFile(t, path, "1")
+	c := NewChecker(Options{StableSeconds: 1, TimeoutSeconds: 10})
+
+	start := time.Now()
+	stop := make(chan struct{})
+	go func() {
+		// Grows for a while
+		for i := 0; i < 5; i++ {
+			time.Sleep(100 * time.Millisecond)
+			f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+			f.WriteString("1")
+			f.Close()
+		}
+		close(stop)
+	}()
+	if err := c.Wait(path); err != nil {
+		t.Fatal(err)
+	}
+	<-stop
+	if d := time.Since(start); d < 1500*time.Millisecond {
+		t.Errorf("stable after %s, want the quiet period after the last write", d)
+	}
+}
+
+func TestWaitRenamed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a")
+	writeFile(t, path, "1")
+	c := NewChecker(Options{StableSeconds: 60, RenameCompletes: true, TimeoutSeconds: 1})
+	c.Observe(fsnotify.Event{Name: filepath.Join(dir, "a.tmp"), Op: fsnotify.Rename})
+	c.Observe(fsnotify.Event{Name: path, Op: fsnotify.Create})
+	if err := c.Wait(path); err != nil {
+		t.Errorf("Wait on a renamed file = %v", err)
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	for _, tt := range []struct {
+		o    Options
+		want bool
+	}{
+		{Options{}, false},
+		{Options{IgnoreSuffixes: []string{".tmp"}, TimeoutSeconds: 10}, false},
+		{Options{StableSeconds: 1}, true},
+		{Options{Markers: []string{".done"}}, true},
+		{Options{RenameCompletes: true}, true},
+	} {
+		if got := tt.o.Enabled(); got != tt.want {
+			t.Errorf("%+v: Enabled() = %t, want %t", tt.o, got, tt.want)
+		}
+	}
+}
+
+func TestHandleRenameOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a")
+	writeFile(t, path, "1")
+	c := NewChecker(Options{RenameCompletes: true, TimeoutSeconds: 10})
+	defer c.Close()
+
+	// A file written in place waits for its close
+	errs := make(chan error, 2)
+	fn := func(err error) { errs <- err }
+	c.Observe(fsnotify.Event{Name: path, Op: fsnotify.Create})
+	if !c.Handle(path, fn) {
+		t.Fatal("not handled")
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("complete on Create, with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Observe(fsnotify.Event{Name: path, Op: fsnotify.Write})
+	c.Observe(fsnotify.Event{Name: path, Op: fsnotify.CloseWrite})
+	if c.Handle(path, fn) {
+		t.Error("the close isn't merged into the wait")
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not complete after the close")
+	}
+
+	// Handled on its close, or renamed into place, it's complete at once
+	c.Observe(fsnotify.Event{Name: path, Op: fsnotify.CloseWrite})
+	c.Observe(fsnotify.Event{Name: filepath.Join(dir, "b.tmp"), Op: fsnotify.Rename})
+	c.Observe(fsnotify.Event{Name: filepath.Join(dir, "b"), Op: fsnotify.Create})
+	writeFile(t, filepath.Join(dir, "b"), "1")
+	for _, p := range []string{path, filepath.Join(dir, "b")} {
+		c.Handle(p, fn)
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("%s: %v", p, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s isn't complete", p)
+		}
+	}
+}
+
+func TestWaitMarker(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.DAT")
+	writeFile(t, path, "1")
+	c := NewChecker(Options{Markers: []string{".CNT"}, TimeoutSeconds: 10})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		writeFile(t, filepath.Join(dir, "a.CNT"), "1")
+	}()
+	if err := c.Wait(path); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewChecker(Options{Markers: []string{".done"}, TimeoutSeconds: 1})
+	if err := c.Wait(path); err != ErrTimeout {
+		t.Errorf("Wait without the marker = %v, want ErrTimeout", err)
+	}
+}
+
+func TestHandleMerges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a")
+	writeFile(t, path, "1")
+	c := NewChecker(Options{StableSeconds: 1, IgnoreSuffixes: []string{".tmp"}, TimeoutSeconds: 10})
+
+	errs := make(chan error, 2)
+	fn := func(err error) { errs <- err }
+	if !c.Handle(path, fn) {
+		t.Fatal("not handled")
+	}
+	if c.Handle(path, fn) {
+		t.Error("the second event of the file isn't merged")
+	}
+	if c.Handle(path+".tmp", fn) {
+		t.Error("a temporary file is handled")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(errs) > 0 {
+		t.Error("fn called twice")
+	}
+
+	// Events after the wait are a new version of the file
+	c = NewChecker(Options{StableSeconds: 1, TimeoutSeconds: 10})
+	c.Handle(path, fn)
+	<-errs
+	if !c.Handle(path, fn) {
+		t.Error("an event after the wait isn't handled")
+	}
+	c.Close()
+}
+
+func TestClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a")
+	writeFile(t, path, "1")
+	c := NewChecker(Options{Markers: []string{".done"}})
+
+	errs := make(chan error, 1)
+	c.Handle(path, func(err error) { errs <- err })
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+	if err := <-errs; err != ErrClosed {
+		t.Errorf("wait stopped with %v, want ErrClosed", err)
+	}
+	if c.Handle(path, func(error) { t.Error("fn called after Close") }) {
+		t.Error("handled after Close")
+	}
+}
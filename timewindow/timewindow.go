@@ -0,0 +1,125 @@
+// Package timewindow splits a span of time into segments at the boundaries of
+// days, hours or a custom interval, e.g. to log a file's records per day.
+package timewindow
+
+import (
+	"fmt"
+	"time"
+)
+
+type Options struct {
+	// "day" (the default), "hour" or a duration like "15m" or "6h". Other
+	// than days, the segments are aligned to midnight and never cross it.
+	Interval string
+
+	// "inclusive" (the default) ends a segment at the last nanosecond before
+	// the next boundary, "exclusive" at the boundary itself. The last
+	// segment always ends at the end of the span.
+	Bounds string
+}
+
+// Segment is a part of a span, Index counts from 1
+type Segment struct {
+	Begin time.Time
+	End   time.Time
+	Index int
+}
+
+type Splitter struct {
+	interval  time.Duration // zero for days
+	exclusive bool
+}
+
+// New checks the options and returns their splitter
+func New(o Options) (*Splitter, error) {
+	s := &Splitter{}
+	switch o.Interval {
+	case "", "day":
+	case "hour":
+		s.interval = time.Hour
+	default:
+		d, err := time.ParseDuration(o.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("timewindow: invalid interval: %s", o.Interval)
+		}
+		if d <= 0 || d > 24*time.Hour {
+			return nil, fmt.Errorf("timewindow: interval out of range: %s", o.Interval)
+		}
+		s.interval = d
+	}
+
+	switch o.Bounds {
+	case "", "inclusive":
+	case "exclusive":
+		s.exclusive = true
+	default:
+		return nil, fmt.Errorf("timewindow: unknown bounds: %s", o.Bounds)
+	}
+	return s, nil
+}
+
+// Midnight returns the start of the day of t in its zone. A day starting
+// with a DST gap has no midnight, it starts at the end of the gap.
+func Midnight(t time.Time) time.Time {
+	return dayStart(t.Year(), t.Month(), t.Day(), t.Location())
+}
+
+// dayStart returns the first instant of the calendar day, the day may be out
+// of the month's range as with time.Date
+func dayStart(year int, month time.Month, day int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	// time.Date may put a midnight in a gap on the day before, the day then
+	// starts at the transition, which is on a whole minute
+	for {
+		y, m, d := t.Date()
+		if !time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Before(date) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+}
+
+// Floor returns the start of the segment containing t
+func (s *Splitter) Floor(t time.Time) time.Time {
+	day := Midnight(t)
+	if s.interval == 0 {
+		return day
+	}
+	return day.Add(t.Sub(day) / s.interval * s.interval)
+}
+
+// Next returns the start of the segment after the one containing t. Days
+// are calendar days, so they may have 23 or 25 hours with DST.
+func (s *Splitter) Next(t time.Time) time.Time {
+	nextDay := dayStart(t.Year(), t.Month(), t.Day()+1, t.Location())
+	if s.interval == 0 {
+		return nextDay
+	}
+	next := s.Floor(t).Add(s.interval)
+	if next.After(nextDay) {
+		next = nextDay
+	}
+	return next
+}
+
+// Split returns the segments of [begin, end] in the zone of begin
+func (s *Splitter) Split(begin, end time.Time) ([]Segment, error) {
+	end = end.In(begin.Location())
+	var segments []Segment
+	for b := begin; ; {
+		next := s.Next(b)
+		if !next.After(b) {
+			return nil, fmt.Errorf("timewindow: no segment after %s", b.Format(time.RFC3339))
+		}
+		if end.Before(next) {
+			return append(segments, Segment{Begin: b, End: end, Index: len(segments) + 1}), nil
+		}
+		e := next
+		if !s.exclusive {
+			e = next.Add(-time.Nanosecond)
+		}
+		segments = append(segments, Segment{Begin: b, End: e, Index: len(segments) + 1})
+		b = next
+	}
+}
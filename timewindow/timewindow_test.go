@@ -0,0 +1,211 @@
+package timewindow
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("no time zone data for %s: %s", name, err)
+	}
+	return loc
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       Options
+		zone       string
+		begin, end string // RFC 3339, begin is put in zone
+		want       []string
+	}{
+		{
+			name: "one day", zone: "Asia/Hong_Kong",
+			begin: "2024-01-02T06:00:00+08:00", end: "2024-01-02T18:00:00+08:00",
+			want: []string{"2024-01-02T06:00:00+08:00 2024-01-02T18:00:00+08:00"},
+		},
+		{
+			name: "days inclusive", zone: "Asia/Hong_Kong",
+			begin: "2024-01-01T22:00:00Z", end: "2024-01-03T17:30:00Z",
+			want: []string{
+				"2024-01-02T06:00:00+08:00 2024-01-02T23:59:59.999999999+08:00",
+				"2024-01-03T00:00:00+08:00 2024-01-03T23:59:59.999999999+08:00",
+				"2024-01-04T00:00:00+08:00 2024-01-04T01:30:00+08:00",
+			},
+		},
+		{
+			name: "days exclusive", opts: Options{Bounds: "exclusive"}, zone: "Asia/Hong_Kong",
+			begin: "2024-01-01T22:00:00+08:00", end: "2024-01-02T01:00:00+08:00",
+			want: []string{
+				"2024-01-01T22:00:00+08:00 2024-01-02T00:00:00+08:00",
+				"2024-01-02T00:00:00+08:00 2024-01-02T01:00:00+08:00",
+			},
+		},
+		{
+			name: "end on a boundary", zone: "Asia/Hong_Kong",
+			begin: "2024-01-01T22:00:00+08:00", end: "2024-01-02T00:00:00+08:00",
+			want: []string{
+				"2024-01-01T22:00:00+08:00 2024-01-01T23:59:59.999999999+08:00",
+				"2024-01-02T00:00:00+08:00 2024-01-02T00:00:00+08:00",
+			},
+		},
+		{
+			name: "hours", opts: Options{Interval: "hour", Bounds: "exclusive"}, zone: "Asia/Hong_Kong",
+			begin: "2024-01-01T22:10:00+08:00", end: "2024-01-02T00:30:00+08:00",
+			want: []string{
+				"2024-01-01T22:10:00+08:00 2024-01-01T23:00:00+08:00",
+				"2024-01-01T23:00:00+08:00 2024-01-02T00:00:00+08:00",
+				"2024-01-02T00:00:00+08:00 2024-01-02T00:30:00+08:00",
+			},
+		},
+		{
+			name: "custom interval capped at midnight", opts: Options{Interval: "10h"}, zone: "Asia/Hong_Kong",
+			begin: "2024-01-01T15:00:00+08:00", end: "2024-01-02T11:00:00+08:00",
+			want: []string{
+				"2024-01-01T15:00:00+08:00 2024-01-01T19:59:59.999999999+08:00",
+				"2024-01-01T20:00:00+08:00 2024-01-01T23:59:59.999999999+08:00",
+				"2024-01-02T00:00:00+08:00 2024-01-02T09:59:59.999999999+08:00",
+				"2024-01-02T10:00:00+08:00 2024-01-02T11:00:00+08:00",
+			},
+		},
+		{
+			name: "23 hour day", opts: Options{Interval: "7h"}, zone: "America/New_York",
+			begin: "2024-03-09T20:00:00-05:00", end: "2024-03-10T23:00:00-04:00",
+			want: []string{
+				"2024-03-09T20:00:00-05:00 2024-03-09T20:59:59.999999999-05:00",
+				"2024-03-09T21:00:00-05:00 2024-03-09T23:59:59.999999999-05:00",
+				"2024-03-10T00:00:00-05:00 2024-03-10T07:59:59.999999999-04:00",
+				"2024-03-10T08:00:00-04:00 2024-03-10T14:59:59.999999999-04:00",
+				"2024-03-10T15:00:00-04:00 2024-03-10T21:59:59.999999999-04:00",
+				"2024-03-10T22:00:00-04:00 2024-03-10T23:00:00-04:00",
+			},
+		},
+		{
+			name: "25 hour day", zone: "America/New_York",
+			begin: "2024-11-02T23:00:00-04:00", end: "2024-11-04T01:00:00-05:00",
+			want: []string{
+				"2024-11-02T23:00:00-04:00 2024-11-02T23:59:59.999999999-04:00",
+				"2024-11-03T00:00:00-04:00 2024-11-03T23:59:59.999999999-05:00",
+				"2024-11-04T00:00:00-05:00 2024-11-04T01:00:00-05:00",
+			},
+		},
+		// DST starts at midnight, these days start at 01:00
+		{
+			name: "Sao Paulo", zone: "America/Sao_Paulo",
+			begin: "2017-10-14T22:00:00-03:00", end: "2017-10-15T03:00:00-02:00",
+			want: []string{
+				"2017-10-14T22:00:00-03:00 2017-10-14T23:59:59.999999999-03:00",
+				"2017-10-15T01:00:00-02:00 2017-10-15T03:00:00-02:00",
+			},
+		},
+		{
+			name: "Sao Paulo hours", opts: Options{Interval: "hour", Bounds: "exclusive"}, zone: "America/Sao_Paulo",
+			begin: "2017-10-14T23:30:00-03:00", end: "2017-10-15T02:30:00-02:00",
+			want: []string{
+				"2017-10-14T23:30:00-03:00 2017-10-15T01:00:00-02:00",
+				"2017-10-15T01:00:00-02:00 2017-10-15T02:00:00-02:00",
+				"2017-10-15T02:00:00-02:00 2017-10-15T02:30:00-02:00",
+			},
+		},
+		{
+			name: "Santiago", zone: "America/Santiago",
+			begin: "2017-08-12T20:00:00-04:00", end: "2017-08-13T02:00:00-03:00",
+			want: []string{
+				"2017-08-12T20:00:00-04:00 2017-08-12T23:59:59.999999999-04:00",
+				"2017-08-13T01:00:00-03:00 2017-08-13T02:00:00-03:00",
+			},
+		},
+		{
+			name: "Havana", zone: "America/Havana",
+			begin: "2017-03-11T20:00:00-05:00", end: "2017-03-12T02:00:00-04:00",
+			want: []string{
+				"2017-03-11T20:00:00-05:00 2017-03-11T23:59:59.999999999-05:00",
+				"2017-03-12T01:00:00-04:00 2017-03-12T02:00:00-04:00",
+			},
+		},
+		{
+			name: "Asuncion", zone: "America/Asuncion",
+			begin: "2017-09-30T20:00:00-04:00", end: "2017-10-01T02:00:00-03:00",
+			want: []string{
+				"2017-09-30T20:00:00-04:00 2017-09-30T23:59:59.999999999-04:00",
+				"2017-10-01T01:00:00-03:00 2017-10-01T02:00:00-03:00",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := loadLocation(t, tt.zone)
+			s, err := New(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			begin, err := time.Parse(time.RFC3339, tt.begin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			end, err := time.Parse(time.RFC3339, tt.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			segments, err := s.Split(begin.In(loc), end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for i, seg := range segments {
+				if seg.Index != i+1 {
+					t.Errorf("segment %d has index %d", i+1, seg.Index)
+				}
+				got = append(got, seg.Begin.Format(time.RFC3339Nano)+" "+seg.End.Format(time.RFC3339Nano))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestMidnight(t *testing.T) {
+	tests := []struct {
+		zone, t, want string
+	}{
+		{"Asia/Hong_Kong", "2024-01-02T15:04:05+08:00", "2024-01-02T00:00:00+08:00"},
+		{"America/Sao_Paulo", "2017-10-15T12:00:00-02:00", "2017-10-15T01:00:00-02:00"},
+		{"America/Sao_Paulo", "2017-10-14T12:00:00-03:00", "2017-10-14T00:00:00-03:00"},
+	}
+	for _, tt := range tests {
+		loc := loadLocation(t, tt.zone)
+		in, _ := time.Parse(time.RFC3339, tt.t)
+		if got := Midnight(in.In(loc)).Format(time.RFC3339); got != tt.want {
+			t.Errorf("Midnight(%s) = %s, want %s", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		opts Options
+		ok   bool
+	}{
+		{Options{}, true},
+		{Options{Interval: "day", Bounds: "inclusive"}, true},
+		{Options{Interval: "hour", Bounds: "exclusive"}, true},
+		{Options{Interval: "15m"}, true},
+		{Options{Interval: "24h"}, true},
+		{Options{Interval: "25h"}, false},
+		{Options{Interval: "0s"}, false},
+		{Options{Interval: "week"}, false},
+		{Options{Bounds: "open"}, false},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.opts); (err == nil) != tt.ok {
+			t.Errorf("New(%+v) error = %v, want ok %t", tt.opts, err, tt.ok)
+		}
+	}
+}